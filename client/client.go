@@ -0,0 +1,312 @@
+// Package client sends metrics to the statsd server built into scoutd, in the line format
+// scoutd parses, including DogStatsD style tags and counter sample rates.
+//
+// Lines are buffered and sent in batches, either when the next line would not fit in a packet,
+// on every flush interval, or on Flush() and Close():
+//
+//	c, err := client.New("127.0.0.1:8125")
+//	c.SetPrefix("myapp.")
+//	c.Incr("requests", "path:/login")
+//	c.Timing("request_time", time.Since(start))
+//	defer c.Close()
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAddr          = "127.0.0.1:8125"
+	DefaultFlushInterval = 100 * time.Millisecond
+	UDPPacketSize        = 1432 // fits in an Ethernet MTU of 1500 with the IP and UDP headers
+	UnixgramPacketSize   = 8192
+	StreamBufferSize     = 8192            // how much is buffered before writing to a tcp or unix stream
+	StreamWriteTimeout   = 5 * time.Second // how long a write to a tcp or unix stream may block
+)
+
+// A statsd client. It is safe for concurrent use.
+type Client struct {
+	network    string
+	address    string
+	conn       net.Conn
+	packetSize int
+	prefix     string
+	tags       []string
+	mutex      sync.Mutex
+	buf        []byte
+	closed     chan bool
+	done       chan bool
+}
+
+// Connects to scoutd at addr, which is udp unless it starts with tcp://, unix:// or
+// unixgram://, eg: unix:///var/run/scoutd-statsd.sock. Buffered lines are sent every
+// DefaultFlushInterval.
+func New(addr string) (*Client, error) {
+	return NewWithInterval(addr, DefaultFlushInterval)
+}
+
+// Like New(), with the given flush interval. With an interval of 0, lines are only sent
+// when a packet is full and on Flush() or Close().
+func NewWithInterval(addr string, flushInterval time.Duration) (*Client, error) {
+	c, err := newClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	c.start(flushInterval)
+	return c, nil
+}
+
+// Like NewWithInterval(), without connecting yet, so scoutd does not need to be reachable.
+// The connection is made on the first flush, and retried on every flush until it succeeds.
+// Only an invalid address is an error.
+func NewUnconnected(addr string, flushInterval time.Duration) (*Client, error) {
+	c, err := newClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.start(flushInterval)
+	return c, nil
+}
+
+func newClient(addr string) (*Client, error) {
+	c := &Client{network: "udp", address: addr, closed: make(chan bool), done: make(chan bool)}
+	if i := strings.Index(addr, "://"); i > 0 {
+		c.network, c.address = addr[:i], addr[i+3:]
+	}
+	switch c.network {
+	case "udp":
+		c.packetSize = UDPPacketSize
+	case "unixgram":
+		c.packetSize = UnixgramPacketSize
+	case "tcp", "unix":
+		c.packetSize = StreamBufferSize
+	default:
+		return nil, fmt.Errorf("unsupported network %q", c.network)
+	}
+	c.buf = make([]byte, 0, c.packetSize)
+	return c, nil
+}
+
+func (c *Client) start(flushInterval time.Duration) {
+	if flushInterval > 0 {
+		go c.flushLoop(flushInterval)
+	} else {
+		close(c.done)
+	}
+}
+
+func (c *Client) connect() error {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+func (c *Client) stream() bool {
+	return c.network == "tcp" || c.network == "unix"
+}
+
+// Sets a prefix for the names of all metrics sent, eg: "myapp."
+func (c *Client) SetPrefix(prefix string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.prefix = prefix
+}
+
+// Sets tags sent with every metric, in "key:value" form
+func (c *Client) SetTags(tags ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.tags = tags
+}
+
+// Adds value to a counter
+func (c *Client) Count(name string, value float64, tags ...string) error {
+	return c.send(name, formatFloat(value), "c", 1, tags)
+}
+
+// Adds 1 to a counter
+func (c *Client) Incr(name string, tags ...string) error {
+	return c.Count(name, 1, tags...)
+}
+
+// Adds value to a counter for only a fraction of the calls, given by rate. scoutd scales
+// the value back up by the rate.
+func (c *Client) SampledCount(name string, value float64, rate float64, tags ...string) error {
+	if rate <= 0 || rate > 1 {
+		return fmt.Errorf("sample rate %v is not above 0 and at most 1", rate)
+	}
+	if rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+	return c.send(name, formatFloat(value), "c", rate, tags)
+}
+
+// Sets a gauge
+func (c *Client) Gauge(name string, value float64, tags ...string) error {
+	return c.send(name, formatFloat(value), "fg", 1, tags)
+}
+
+// Adjusts a gauge by delta, which may be negative
+func (c *Client) GaugeDelta(name string, delta float64, tags ...string) error {
+	value := formatFloat(delta)
+	if delta >= 0 {
+		value = "+" + value
+	}
+	return c.send(name, value, "fg", 1, tags)
+}
+
+// Records a duration in a timer, in milliseconds
+func (c *Client) Timing(name string, d time.Duration, tags ...string) error {
+	return c.send(name, formatFloat(float64(d)/float64(time.Millisecond)), "ms", 1, tags)
+}
+
+// Records a duration in a precision timer, kept at nanosecond precision by scoutd
+func (c *Client) PrecisionTiming(name string, d time.Duration, tags ...string) error {
+	return c.send(name, formatFloat(float64(d)/float64(time.Millisecond)), "pt", 1, tags)
+}
+
+// Sends a line already in statsd format, eg: to repeat lines received from elsewhere
+func (c *Client) SendLine(line string) error {
+	if line == "" || strings.ContainsRune(line, '\n') {
+		return fmt.Errorf("invalid line %q", line)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.appendLine([]byte(line))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Builds a line like name:value|type|@rate|#tag,tag and adds it to the buffer
+func (c *Client) send(name string, value string, metricType string, rate float64, tags []string) error {
+	if name == "" || strings.ContainsAny(name, ":|\n") {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, ",|\n") {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	line := make([]byte, 0, len(c.prefix)+len(name)+len(value)+32)
+	line = append(line, c.prefix...)
+	line = append(line, name...)
+	line = append(line, ':')
+	line = append(line, value...)
+	line = append(line, '|')
+	line = append(line, metricType...)
+	if rate < 1 {
+		line = append(line, "|@"...)
+		line = strconv.AppendFloat(line, rate, 'f', -1, 64)
+	}
+	if len(c.tags)+len(tags) > 0 {
+		line = append(line, "|#"...)
+		line = append(line, strings.Join(append(append([]string{}, c.tags...), tags...), ",")...)
+	}
+	return c.appendLine(line)
+}
+
+// Adds a line to the buffer, flushing it first if the line does not fit.
+// Must be called with c.mutex held.
+func (c *Client) appendLine(line []byte) error {
+	if len(line) > c.packetSize {
+		return fmt.Errorf("line %.40q... is too long to send", line)
+	}
+	// Lines are separated by newlines within a packet, and terminated by them on a stream
+	needed := len(line)
+	if len(c.buf) > 0 || c.stream() {
+		needed++
+	}
+	if len(c.buf)+needed > c.packetSize {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	if len(c.buf) > 0 && !c.stream() {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+	if c.stream() {
+		c.buf = append(c.buf, '\n')
+	}
+	return nil
+}
+
+// Sends the buffered lines now
+func (c *Client) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.flush()
+}
+
+// Must be called with c.mutex held. The buffer is emptied even on error, as for udp, so a
+// scoutd that is down does not make the buffer grow. A broken stream is reconnected on the
+// next flush, as is one that has not been read from within StreamWriteTimeout, so a stuck
+// scoutd cannot block the caller.
+func (c *Client) flush() error {
+	if len(c.buf) == 0 {
+		return nil
+	}
+	defer func() { c.buf = c.buf[:0] }()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+	if c.stream() {
+		c.conn.SetWriteDeadline(time.Now().Add(StreamWriteTimeout))
+	}
+	if _, err := c.conn.Write(c.buf); err != nil {
+		if c.stream() {
+			c.conn.Close()
+			c.conn = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Client) flushLoop(interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Sends the buffered lines and closes the connection
+func (c *Client) Close() error {
+	close(c.closed)
+	<-c.done
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err := c.flush()
+	if c.conn != nil {
+		if closeErr := c.conn.Close(); err == nil {
+			err = closeErr
+		}
+		c.conn = nil
+	}
+	return err
+}
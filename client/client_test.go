@@ -0,0 +1,176 @@
+package client_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/client"
+	"github.com/pingdomserver/scoutd/client/clienttest"
+)
+
+func TestClientNetworks(t *testing.T) {
+	for _, network := range []string{"udp", "tcp", "unix", "unixgram"} {
+		srv, err := clienttest.NewServer(network)
+		if err != nil {
+			t.Fatalf("%s server: %s", network, err)
+		}
+		c, err := client.NewWithInterval(srv.Addr, 0)
+		if err != nil {
+			t.Fatalf("%s client: %s", network, err)
+		}
+		c.SetPrefix("app.")
+		c.SetTags("env:test")
+		c.Incr("requests", "path:/")
+		c.Count("requests", 2, "path:/")
+		c.Gauge("queue", 10)
+		c.GaugeDelta("queue", -3)
+		c.Timing("latency", 1500*time.Microsecond)
+		if err := c.Close(); err != nil {
+			t.Fatalf("%s close: %s", network, err)
+		}
+		if err := srv.WaitForEvents(5, time.Second); err != nil {
+			t.Fatalf("%s: %s", network, err)
+		}
+		metrics := srv.Metrics()
+		if m := clienttest.Lookup(metrics, "app.requests", "env:test", "path:/"); m == nil || m.Value != 3 {
+			t.Errorf("%s counter: 3 != %v", network, m)
+		}
+		if m := clienttest.Lookup(metrics, "app.queue", "env:test"); m == nil || m.Value != 7 {
+			t.Errorf("%s gauge: 7 != %v", network, m)
+		}
+		if m := clienttest.Lookup(metrics, "app.latency.max", "env:test"); m == nil || m.Value != 1.5 {
+			t.Errorf("%s timer: 1.5 != %v", network, m)
+		}
+		srv.Close()
+	}
+}
+
+func TestClientBatching(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	c, err := client.NewWithInterval(conn.LocalAddr().String(), 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sent := 200
+	for i := 0; i < sent; i++ {
+		c.SampledCount("a.fairly.long.metric.name.for.batching", 1, 1, "host:web01")
+	}
+	c.Close()
+
+	lines := 0
+	packets := 0
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for lines < sent {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Received %d of %d lines: %s", lines, sent, err)
+		}
+		if n > client.UDPPacketSize {
+			t.Errorf("Packet of %d bytes is larger than %d", n, client.UDPPacketSize)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line != "a.fairly.long.metric.name.for.batching:1|c|#host:web01" {
+				t.Fatalf("Unexpected line %q", line)
+			}
+			lines++
+		}
+		packets++
+	}
+	if packets >= sent/10 {
+		t.Errorf("%d lines were sent in %d packets", sent, packets)
+	}
+}
+
+func TestClientInvalid(t *testing.T) {
+	c, err := client.NewWithInterval("127.0.0.1:8125", 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer c.Close()
+	if err := c.Incr("bad:name"); err == nil {
+		t.Errorf("No error on a name with a colon")
+	}
+	if err := c.Incr("name", "bad,tag"); err == nil {
+		t.Errorf("No error on a tag with a comma")
+	}
+	if err := c.SampledCount("name", 1, 0); err == nil {
+		t.Errorf("No error on a sample rate of 0")
+	}
+	if err := c.Incr(strings.Repeat("x", client.UDPPacketSize)); err == nil {
+		t.Errorf("No error on a line longer than a packet")
+	}
+	if _, err := client.New("sctp://127.0.0.1:8125"); err == nil {
+		t.Errorf("No error on an unsupported network")
+	}
+}
+
+func TestClientSampleRate(t *testing.T) {
+	srv, err := clienttest.NewServer("udp")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer srv.Close()
+	c, err := client.NewWithInterval(srv.Addr, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	c.SendLine("sampled:1|c|@0.5") // as sent by SampledCount() when this call is picked
+	c.Close()
+	if err := srv.WaitForEvents(1, time.Second); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if m := clienttest.Lookup(srv.Metrics(), "sampled"); m == nil || m.Value != 2 {
+		t.Errorf("Sampled counter scaled by rate: 2 != %v", m)
+	}
+}
+
+func TestClientUnconnected(t *testing.T) {
+	if _, err := client.NewUnconnected("ftp://127.0.0.1:8125", 0); err == nil {
+		t.Errorf("No error on an unsupported network")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if _, err := client.NewWithInterval("tcp://"+addr, 0); err == nil {
+		t.Fatalf("No error connecting to a closed port")
+	}
+	c, err := client.NewUnconnected("tcp://"+addr, 0)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer c.Close()
+	c.Incr("lost")
+	if err := c.Flush(); err == nil {
+		t.Errorf("No error flushing to a closed port")
+	}
+
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("port %s was taken in the meantime: %s", addr, err)
+	}
+	defer l.Close()
+	c.Incr("requests")
+	if err := c.Flush(); err != nil {
+		t.Fatalf("Flush once listening: %s", err)
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, _ := conn.Read(buf)
+	if got := string(buf[:n]); got != "requests:1|c\n" {
+		t.Errorf("Sent once connected: %q", got)
+	}
+}
@@ -0,0 +1,147 @@
+// Package clienttest runs an in-process scoutd statsd collector, so tests can assert on the
+// metrics their code emits:
+//
+//	srv, err := clienttest.NewServer("udp")
+//	defer srv.Close()
+//	c, err := client.New(srv.Addr)
+//	c.Incr("requests")
+//	c.Flush()
+//	srv.WaitForEvents(1, time.Second)
+//	m := clienttest.Lookup(srv.Metrics(), "requests")
+package clienttest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// A statsd collector listening on a local address, flushed only on demand
+type Server struct {
+	Addr     string // The address to pass to client.New()
+	sd       *collectors.StatsdCollector
+	sub      *collectors.Subscription
+	received int
+	listener io.Closer
+	dir      string
+}
+
+// Starts a collector listening on network, one of udp, tcp, unix or unixgram.
+// The udp and tcp servers listen on a random port on 127.0.0.1, the unix ones in a
+// temporary directory.
+func NewServer(network string) (*Server, error) {
+	sd, err := collectors.NewStatsdCollector("statsd", "", time.Hour, 10000)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{sd: sd}
+	address := "127.0.0.1:0"
+	if network == "unix" || network == "unixgram" {
+		if s.dir, err = ioutil.TempDir("", "clienttest"); err != nil {
+			return nil, err
+		}
+		address = filepath.Join(s.dir, "statsd.sock")
+	}
+	if s.sub, err = sd.Subscribe(nil); err != nil {
+		return nil, err
+	}
+	switch network {
+	case "udp", "unixgram":
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listener = conn
+		address = conn.LocalAddr().String()
+		sd.StartWith(conn, nil)
+	case "tcp", "unix":
+		l, err := net.Listen(network, address)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.listener = l
+		address = l.Addr().String()
+		sd.StartListener(l)
+	default:
+		s.Close()
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	s.Addr = network + "://" + address
+	return s, nil
+}
+
+// Returns the collector, eg: to configure it like the daemon's. Configure it before sending.
+func (s *Server) Collector() *collectors.StatsdCollector {
+	return s.sd
+}
+
+// Waits until the collector has aggregated n events in total since the server started,
+// one for each line received, or returns an error after timeout
+func (s *Server) WaitForEvents(n int, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	// Events the subscription dropped while the test was busy sending still count
+	for s.received+int(s.sub.Dropped()) < n {
+		select {
+		case <-s.sub.Events:
+			s.received++
+		case <-deadline:
+			return fmt.Errorf("received %d of %d events in %s", s.received, n, timeout)
+		}
+	}
+	return nil
+}
+
+// Flushes the collector, and returns the metrics aggregated since the previous flush,
+// sorted by name. Call WaitForEvents() first, as lines are received asynchronously.
+func (s *Server) Metrics() []*event.Metric {
+	s.sd.Flush()
+	metrics := s.sd.Payload().Metrics
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// Returns the metric with the given name and exactly the given tags, or nil
+func Lookup(metrics []*event.Metric, name string, tags ...string) *event.Metric {
+	sort.Strings(tags)
+	for _, m := range metrics {
+		if m.Name != name || len(m.Tags) != len(tags) {
+			continue
+		}
+		mtags := append([]string{}, m.Tags...)
+		sort.Strings(mtags)
+		match := true
+		for i := range tags {
+			if tags[i] != mtags[i] {
+				match = false
+			}
+		}
+		if match {
+			return m
+		}
+	}
+	return nil
+}
+
+// Stops the collector and its listener
+func (s *Server) Close() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.sub != nil {
+		s.sd.Unsubscribe(s.sub)
+	}
+	s.sd.Shutdown()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
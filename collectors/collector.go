@@ -17,6 +17,7 @@ type Collector interface {
 	Collect() error
 	Payload() *CollectorPayload
 	ReceiveCollectorMessage(CollectorMessage)
+	Shutdown() error
 }
 
 type CollectorMessage struct {
@@ -26,6 +27,16 @@ type CollectorMessage struct {
 	Data        json.RawMessage `json:"data"`
 }
 
+// The version of the json checkin bundle schema, reported as its schema_version.
+// Version 1 had no schema_version, and no flush window or sample count on its metrics.
+const PayloadSchemaVersion = 2
+
+// A struct representing the top level of the json checkin bundle
+type PayloadBundle struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Collectors    []*CollectorPayload `json:"collectors"`
+}
+
 // A struct representing the Collector's data in the json checkin bundle
 type CollectorPayload struct {
 	Name    string          `json:"name"`
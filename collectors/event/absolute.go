@@ -0,0 +1,76 @@
+package event
+
+import "fmt"
+
+// Absolute is a counter of integer values that is neither sampled nor averaged.
+// The values received during a flush interval are summed, and reset on flush.
+type Absolute struct {
+	Name  string
+	Value int64
+	Tags  []string
+}
+
+// Update the event with metrics coming from a new one of the same type and with the same key
+func (e *Absolute) Update(e2 Event) error {
+	if e.Type() != e2.Type() {
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	e.Value += e2.Payload().(int64)
+	return nil
+}
+
+// Resets the Value to 0
+func (e *Absolute) Reset() {
+	e.Value = 0
+}
+
+func (e *Absolute) Copy() Event {
+	e2 := &Absolute{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e Absolute) Payload() interface{} {
+	return e.Value
+}
+
+func (e Absolute) Metrics() []*Metric {
+	return []*Metric{
+		{Name: e.Name, Value: float64(e.Value), Type: "absolute", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e Absolute) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *Absolute) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e Absolute) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *Absolute) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e Absolute) Type() int {
+	return EventAbsolute
+}
+
+// TypeString returns a name for this type of metric
+func (e Absolute) TypeString() string {
+	return "Absolute"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e Absolute) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Value: %d}", e.TypeString(), e.Name, e.Value)
+}
@@ -0,0 +1,40 @@
+package event
+
+import "testing"
+
+func TestAbsolute(t *testing.T) {
+	e := &Absolute{Name: "absolute", Value: 3}
+	e.Update(&Absolute{Name: "absolute", Value: 4})
+	if metrics := e.Metrics(); metrics[0].Value != 7 || metrics[0].Type != "absolute" {
+		t.Errorf("Absolute metric: 7 absolute != %v %s", metrics[0].Value, metrics[0].Type)
+	}
+	e.Reset()
+	if e.Value != 0 {
+		t.Errorf("Absolute after reset: 0 != %v", e.Value)
+	}
+	if err := e.Update(&FAbsolute{Name: "absolute", Value: 1}); err == nil {
+		t.Errorf("No error updating Absolute with FAbsolute")
+	}
+}
+
+func TestFAbsolute(t *testing.T) {
+	e := &FAbsolute{Name: "fabsolute", Value: 0.25}
+	e.Update(&FAbsolute{Name: "fabsolute", Value: 0.5})
+	if metrics := e.Metrics(); metrics[0].Value != 0.75 || metrics[0].Type != "absolute" {
+		t.Errorf("FAbsolute metric: 0.75 absolute != %v %s", metrics[0].Value, metrics[0].Type)
+	}
+	e.Reset()
+	if e.Value != 0 {
+		t.Errorf("FAbsolute after reset: 0 != %v", e.Value)
+	}
+}
+
+func TestTotal(t *testing.T) {
+	e := &Total{Name: "total", Value: 2}
+	e.Update(&Total{Name: "total", Value: 3})
+	e.Reset()
+	e.Update(&Total{Name: "total", Value: 5})
+	if metrics := e.Metrics(); metrics[0].Value != 10 || metrics[0].Type != "total" {
+		t.Errorf("Total metric: 10 total != %v %s", metrics[0].Value, metrics[0].Type)
+	}
+}
@@ -0,0 +1,76 @@
+package event
+
+import "fmt"
+
+// FAbsolute is the floating point flavor of Absolute: a counter that is neither sampled
+// nor averaged. The values received during a flush interval are summed, and reset on flush.
+type FAbsolute struct {
+	Name  string
+	Value float64
+	Tags  []string
+}
+
+// Update the event with metrics coming from a new one of the same type and with the same key
+func (e *FAbsolute) Update(e2 Event) error {
+	if e.Type() != e2.Type() {
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	e.Value += e2.Payload().(float64)
+	return nil
+}
+
+// Resets the Value to 0
+func (e *FAbsolute) Reset() {
+	e.Value = 0
+}
+
+func (e *FAbsolute) Copy() Event {
+	e2 := &FAbsolute{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e FAbsolute) Payload() interface{} {
+	return e.Value
+}
+
+func (e FAbsolute) Metrics() []*Metric {
+	return []*Metric{
+		{Name: e.Name, Value: e.Value, Type: "absolute", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e FAbsolute) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *FAbsolute) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e FAbsolute) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *FAbsolute) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e FAbsolute) Type() int {
+	return EventFAbsolute
+}
+
+// TypeString returns a name for this type of metric
+func (e FAbsolute) TypeString() string {
+	return "FAbsolute"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e FAbsolute) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Value: %f}", e.TypeString(), e.Name, e.Value)
+}
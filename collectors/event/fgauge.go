@@ -0,0 +1,81 @@
+package event
+
+import "fmt"
+
+// FGauge - the floating point gauge of gostatsd. Like Gauge, once set it keeps its value
+// until it is changed again, either by a new FGauge or by an FGaugeDelta.
+type FGauge struct {
+	Name  string
+	Value float64
+	Tags  []string
+}
+
+// Update the event with metrics coming from a new FGauge, which replaces the value,
+// or an FGaugeDelta, which adjusts it
+func (e *FGauge) Update(e2 Event) error {
+	switch e2.Type() {
+	case EventFGauge:
+		e.Value = e2.Payload().(float64)
+	case EventFGaugeDelta:
+		e.Value += e2.Payload().(float64)
+	default:
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	return nil
+}
+
+// Reset is a noop on FGauge events
+func (e *FGauge) Reset() {
+	return
+}
+
+func (e *FGauge) Copy() Event {
+	e2 := &FGauge{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e FGauge) Payload() interface{} {
+	return e.Value
+}
+
+func (e FGauge) Metrics() []*Metric {
+	return []*Metric{
+		{Name: e.Name, Value: e.Value, Type: "gauge", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e FGauge) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *FGauge) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e FGauge) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *FGauge) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e FGauge) Type() int {
+	return EventFGauge
+}
+
+// TypeString returns a name for this type of metric
+func (e FGauge) TypeString() string {
+	return "FGauge"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e FGauge) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Value: %f}", e.TypeString(), e.Name, e.Value)
+}
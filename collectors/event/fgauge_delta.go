@@ -0,0 +1,81 @@
+package event
+
+import "fmt"
+
+// FGaugeDelta adjusts a floating point gauge by a relative amount, eg: "+3" or "-1.5".
+// A delta received before any FGauge value starts the gauge from 0.
+type FGaugeDelta struct {
+	Name  string
+	Value float64
+	Tags  []string
+}
+
+// Update the event with metrics coming from a new FGaugeDelta, which adjusts the value,
+// or an FGauge, which replaces it
+func (e *FGaugeDelta) Update(e2 Event) error {
+	switch e2.Type() {
+	case EventFGauge:
+		e.Value = e2.Payload().(float64)
+	case EventFGaugeDelta:
+		e.Value += e2.Payload().(float64)
+	default:
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	return nil
+}
+
+// Reset is a noop on FGaugeDelta events, the gauge keeps its value
+func (e *FGaugeDelta) Reset() {
+	return
+}
+
+func (e *FGaugeDelta) Copy() Event {
+	e2 := &FGaugeDelta{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e FGaugeDelta) Payload() interface{} {
+	return e.Value
+}
+
+func (e FGaugeDelta) Metrics() []*Metric {
+	return []*Metric{
+		{Name: e.Name, Value: e.Value, Type: "gauge", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e FGaugeDelta) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *FGaugeDelta) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e FGaugeDelta) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *FGaugeDelta) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e FGaugeDelta) Type() int {
+	return EventFGaugeDelta
+}
+
+// TypeString returns a name for this type of metric
+func (e FGaugeDelta) TypeString() string {
+	return "FGaugeDelta"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e FGaugeDelta) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Value: %+f}", e.TypeString(), e.Name, e.Value)
+}
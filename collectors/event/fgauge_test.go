@@ -0,0 +1,32 @@
+package event
+
+import "testing"
+
+func TestFGaugeDelta(t *testing.T) {
+	e := &FGauge{Name: "fgauge", Value: 10}
+	e.Update(&FGaugeDelta{Name: "fgauge", Value: 2.5})
+	e.Update(&FGaugeDelta{Name: "fgauge", Value: -1})
+	e.Reset()
+	if e.Value != 11.5 {
+		t.Errorf("FGauge after deltas and reset: 11.5 != %v", e.Value)
+	}
+	e.Update(&FGauge{Name: "fgauge", Value: 3})
+	if e.Value != 3 {
+		t.Errorf("FGauge after new value: 3 != %v", e.Value)
+	}
+	if err := e.Update(&Gauge{Name: "fgauge", Value: 1}); err == nil {
+		t.Errorf("No error updating FGauge with Gauge")
+	}
+}
+
+func TestFGaugeDeltaFirst(t *testing.T) {
+	e := &FGaugeDelta{Name: "fgauge", Value: -2}
+	e.Update(&FGaugeDelta{Name: "fgauge", Value: 5})
+	if metrics := e.Metrics(); metrics[0].Value != 3 || metrics[0].Type != "gauge" {
+		t.Errorf("FGaugeDelta metric: 3 gauge != %v %s", metrics[0].Value, metrics[0].Type)
+	}
+	e.Update(&FGauge{Name: "fgauge", Value: 1})
+	if e.Value != 1 {
+		t.Errorf("FGaugeDelta after new value: 1 != %v", e.Value)
+	}
+}
@@ -17,7 +17,6 @@ func (e *Gauge) Update(e2 Event) error {
 		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
 	}
 	e.Value = e2.Payload().(float64)
-	e.Tags = []string{}
 	return nil
 }
 
@@ -38,7 +37,7 @@ func (e Gauge) Payload() interface{} {
 
 func (e Gauge) Metrics() []*Metric {
 	return []*Metric{
-		{e.Name, e.Value, "gauge", e.Tags},
+		{Name: e.Name, Value: e.Value, Type: "gauge", Tags: e.Tags},
 	}
 }
 
@@ -52,6 +51,16 @@ func (e *Gauge) SetKey(key string) {
 	e.Name = key
 }
 
+// GetTags returns the tags of this metric, in "key:value" form
+func (e Gauge) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *Gauge) SetTags(tags []string) {
+	e.Tags = tags
+}
+
 // Type returns an integer identifier for this type of metric
 func (e Gauge) Type() int {
 	return EventGauge
@@ -8,6 +8,9 @@ type Increment struct {
 	Value float64
 	SampleRate float64
 	Tags  []string
+	Total float64 // The sum of all previous flush intervals. Survives Reset()
+	Interval float64 // The length of the flush window in seconds. If set, Metrics() includes a per-second rate
+	Cumulative bool // If true, Metrics() includes the running total
 }
 
 // Update the event with metrics coming from a new one of the same type and with the same key
@@ -15,19 +18,22 @@ func (e *Increment) Update(e2 Event) error {
 	if e.Type() != e2.Type() {
 		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
 	}
-	e.Value += e2.Payload().(float64)
-	e.Tags = []string{}
+	// Value is stored scaled by the sample rate from here on
+	e.Value = e.Payload().(float64) + e2.Payload().(float64)
+	e.SampleRate = 1.0
 	return nil
 }
 
-// Resets the Value to 0
+// Resets the Value to 0, adding it to the running Total
 func (e *Increment) Reset() {
+	e.Total += e.Payload().(float64)
 	e.Value = 0
+	e.SampleRate = 1.0
 	return
 }
 
 func (e *Increment) Copy() Event {
-	e2 := &Increment{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	e2 := &Increment{Name: e.Name, Value: e.Value, SampleRate: e.SampleRate, Tags: e.Tags, Total: e.Total, Interval: e.Interval, Cumulative: e.Cumulative}
 	return e2
 }
 
@@ -41,9 +47,17 @@ func (e Increment) Payload() interface{} {
 
 // Stats returns an array of StatsD events as they travel over UDP
 func (e Increment) Metrics() []*Metric {
-	return []*Metric{
-		{e.Name, e.Value, "counter", e.Tags},
+	value := e.Payload().(float64)
+	metrics := []*Metric{
+		{Name: e.Name, Value: value, Type: "counter", Tags: e.Tags},
 	}
+	if e.Interval > 0 {
+		metrics = append(metrics, &Metric{Name: fmt.Sprintf("%s.rate", e.Name), Value: value / e.Interval, Type: "counter_rate", Tags: e.Tags})
+	}
+	if e.Cumulative {
+		metrics = append(metrics, &Metric{Name: fmt.Sprintf("%s.total", e.Name), Value: e.Total + value, Type: "cumulative_counter", Tags: e.Tags})
+	}
+	return metrics
 }
 
 // Key returns the name of this metric
@@ -56,6 +70,16 @@ func (e *Increment) SetKey(key string) {
 	e.Name = key
 }
 
+// GetTags returns the tags of this metric, in "key:value" form
+func (e Increment) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *Increment) SetTags(tags []string) {
+	e.Tags = tags
+}
+
 // Type returns an integer identifier for this type of metric
 func (e Increment) Type() int {
 	return EventIncr
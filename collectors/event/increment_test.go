@@ -0,0 +1,51 @@
+package event
+
+import "testing"
+
+func TestIncrementRate(t *testing.T) {
+	e := &Increment{Name: "requests", Value: 120, Interval: 60}
+	metrics := e.Metrics()
+	if len(metrics) != 2 {
+		t.Fatalf("Metrics with rate: 2 != %d", len(metrics))
+	}
+	if metrics[1].Name != "requests.rate" || metrics[1].Type != "counter_rate" {
+		t.Errorf("Rate metric: requests.rate counter_rate != %s %s", metrics[1].Name, metrics[1].Type)
+	}
+	if metrics[1].Value != 2 {
+		t.Errorf("Rate: 2 != %v", metrics[1].Value)
+	}
+}
+
+func TestIncrementCumulative(t *testing.T) {
+	e := &Increment{Name: "requests", Value: 3, Cumulative: true}
+	e.Reset()
+	e.Update(&Increment{Name: "requests", Value: 4})
+	metrics := e.Copy().Metrics()
+	if len(metrics) != 2 {
+		t.Fatalf("Metrics with cumulative total: 2 != %d", len(metrics))
+	}
+	if metrics[0].Value != 4 {
+		t.Errorf("Counter after reset: 4 != %v", metrics[0].Value)
+	}
+	if metrics[1].Name != "requests.total" || metrics[1].Type != "cumulative_counter" {
+		t.Errorf("Cumulative metric: requests.total cumulative_counter != %s %s", metrics[1].Name, metrics[1].Type)
+	}
+	if metrics[1].Value != 7 {
+		t.Errorf("Cumulative total: 7 != %v", metrics[1].Value)
+	}
+}
+
+func TestIncrementSampleRate(t *testing.T) {
+	e := &Increment{Name: "sampled", Value: 1, SampleRate: 0.5}
+	if m := e.Copy().Metrics(); m[0].Value != 2 {
+		t.Errorf("Sampled counter metric: 2 != %v", m[0].Value)
+	}
+	e.Update(&Increment{Name: "sampled", Value: 1, SampleRate: 0.25})
+	if m := e.Metrics(); m[0].Value != 6 {
+		t.Errorf("Sampled counter metric after update: 6 != %v", m[0].Value)
+	}
+	e.Reset()
+	if e.Total != 6 || e.Payload() != 0.0 {
+		t.Errorf("Sampled counter after reset: total 6, value 0 != %v, %v", e.Total, e.Payload())
+	}
+}
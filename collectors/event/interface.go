@@ -16,10 +16,14 @@ const (
 
 // A struct representing the metric in the json checkin bundle
 type Metric struct {
-	Name  string   `json:"name"`
-	Value float64  `json:"value"`
-	Type  string   `json:"type"`
-	Tags  []string `json:"tags"`
+	Name        string   `json:"name"`
+	Value       float64  `json:"value"`
+	Type        string   `json:"type"`
+	Tags        []string `json:"tags"`
+	WindowStart int64    `json:"window_start"` // Unix time the flush window began
+	WindowEnd   int64    `json:"window_end"`   // Unix time the flush window ended
+	Interval    float64  `json:"interval"`     // Length of the flush window in seconds
+	Samples     int64    `json:"samples"`      // Number of events aggregated into this value during the window
 }
 
 // Event is an interface to a generic StatsD event
@@ -34,4 +38,6 @@ type Event interface {
 	String() string
 	Key() string
 	SetKey(string)
+	GetTags() []string
+	SetTags([]string)
 }
@@ -0,0 +1,118 @@
+package event
+
+import (
+	"fmt"
+	"time"
+)
+
+// PrecisionTiming keeps min/max/mean information about a timer over a certain interval,
+// with nanosecond precision. Unlike Timing it does not keep every value, so it has no
+// percentiles, but its memory use does not grow with the number of values received.
+type PrecisionTiming struct {
+	Name  string
+	Min   time.Duration
+	Max   time.Duration
+	Value time.Duration
+	Count int64
+	Tags  []string
+}
+
+// NewPrecisionTiming is a factory for a PrecisionTiming event, setting the Count to 1 to prevent div_by_0 errors
+func NewPrecisionTiming(k string, delta time.Duration) *PrecisionTiming {
+	return &PrecisionTiming{Name: k, Min: delta, Max: delta, Value: delta, Count: 1, Tags: []string{}}
+}
+
+// Update the event with metrics coming from a new one of the same type and with the same key
+func (e *PrecisionTiming) Update(e2 Event) error {
+	if e.Type() != e2.Type() {
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	p := e2.Payload().(PrecisionTiming)
+	if e.Count == 0 { // Count will only be 0 after Reset()
+		e.Min = p.Min
+		e.Max = p.Max
+	} else {
+		if p.Min < e.Min {
+			e.Min = p.Min
+		}
+		if p.Max > e.Max {
+			e.Max = p.Max
+		}
+	}
+	e.Value += p.Value
+	e.Count += p.Count
+	return nil
+}
+
+// Resets Min/Max/Value/Count to 0
+func (e *PrecisionTiming) Reset() {
+	e.Min = 0
+	e.Max = 0
+	e.Value = 0
+	e.Count = 0
+}
+
+// Return a copy of this PrecisionTiming event
+func (e *PrecisionTiming) Copy() Event {
+	e2 := &PrecisionTiming{Name: e.Name, Min: e.Min, Max: e.Max, Value: e.Value, Count: e.Count, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e PrecisionTiming) Payload() interface{} {
+	return e
+}
+
+// Metrics are reported in milliseconds, like Timing
+func (e PrecisionTiming) Metrics() []*Metric {
+	var meanVal float64
+	if e.Count > 0 {
+		meanVal = durationMillis(e.Value) / float64(e.Count)
+	}
+	return []*Metric{
+		{Name: fmt.Sprintf("%s.count", e.Name), Value: float64(e.Count), Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.sum", e.Name), Value: durationMillis(e.Value), Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.mean", e.Name), Value: meanVal, Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.min", e.Name), Value: durationMillis(e.Min), Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.max", e.Name), Value: durationMillis(e.Max), Type: "timer", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e PrecisionTiming) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *PrecisionTiming) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e PrecisionTiming) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *PrecisionTiming) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e PrecisionTiming) Type() int {
+	return EventPrecisionTiming
+}
+
+// TypeString returns a name for this type of metric
+func (e PrecisionTiming) TypeString() string {
+	return "PrecisionTiming"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e PrecisionTiming) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Min: %s, Max: %s, Value: %s, Count: %d}", e.TypeString(), e.Name, e.Min, e.Max, e.Value, e.Count)
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
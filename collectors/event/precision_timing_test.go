@@ -0,0 +1,33 @@
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrecisionTiming(t *testing.T) {
+	e := NewPrecisionTiming("precise", 1500*time.Microsecond)
+	e.Update(NewPrecisionTiming("precise", 250*time.Microsecond))
+	e.Update(NewPrecisionTiming("precise", 2*time.Millisecond))
+	expected := map[string]float64{
+		"precise.count": 3,
+		"precise.sum":   3.75,
+		"precise.mean":  1.25,
+		"precise.min":   0.25,
+		"precise.max":   2,
+	}
+	for _, m := range e.Metrics() {
+		if m.Value != expected[m.Name] {
+			t.Errorf("%s: %v != %v", m.Name, expected[m.Name], m.Value)
+		}
+	}
+}
+
+func TestPrecisionTimingAfterReset(t *testing.T) {
+	e := NewPrecisionTiming("precise", time.Second)
+	e.Reset()
+	e.Update(NewPrecisionTiming("precise", 5*time.Millisecond))
+	if e.Min != 5*time.Millisecond || e.Max != 5*time.Millisecond || e.Count != 1 {
+		t.Errorf("PrecisionTiming after reset: {5ms 5ms 1} != {%s %s %d}", e.Min, e.Max, e.Count)
+	}
+}
@@ -3,6 +3,8 @@ package event
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type float64Slice []float64
@@ -29,11 +31,14 @@ func (p float64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p float64Slice) PercentileSummary(pct float64) *PercentileSummary {
 	ps := &PercentileSummary{}
 	ps.threshold = pct
-	ps.thresholdString = fmt.Sprintf("%.0f", pct * 100)
+	ps.thresholdString = thresholdString(pct)
 	count := len(p)
 	if (count > 1) {
 		sort.Sort(p)
 		nrThreshold := int((pct * float64(count)) + 0.5)
+		if nrThreshold < 1 { // low percentiles of few values
+			nrThreshold = 1
+		}
 		threshSlice := p[:nrThreshold]
 		ps.sum = threshSlice.Sum()
 		ps.mean = ps.sum / float64(len(threshSlice))
@@ -46,6 +51,12 @@ func (p float64Slice) PercentileSummary(pct float64) *PercentileSummary {
 	return ps
 }
 
+// Formats a percentile threshold for use in metric names, eg: 0.95 as "95" and 0.999 as "99_9"
+func thresholdString(pct float64) string {
+	s := strings.TrimRight(strconv.FormatFloat(pct*100, 'f', 4, 64), "0")
+	return strings.Replace(strings.TrimSuffix(s, "."), ".", "_", 1)
+}
+
 type PercentileSummary struct {
 	threshold float64
 	thresholdString string
@@ -63,8 +74,14 @@ type Timing struct {
 	Values float64Slice
 	Count float64
 	Tags  []string
+	Buckets []float64 // Sorted histogram bucket upper bounds. If set, Metrics() includes bucket counts
+	Stats []string // Which of count, sum, mean, min and max Metrics() includes. All of them if nil
+	Percentiles []float64 // The percentiles Metrics() includes, eg: 0.999. Only 0.95 if nil
 }
 
+// The statistics a Timing reports when its Stats are not set
+var TimingStats = []string{"count", "sum", "mean", "min", "max"}
+
 // NewTiming is a factory for a Timing event, setting the Count to 1 to prevent div_by_0 errors
 func NewTiming(k string, delta float64) *Timing {
 	fs := []float64{delta}
@@ -78,12 +95,32 @@ func (e *Timing) Percentile(pct float64) *PercentileSummary {
 func (e *Timing) PercentileMetrics(pct float64) []*Metric {
 	ps := e.Percentile(pct)
 	return []*Metric{
-		{fmt.Sprintf("%s.sum_%s", e.Name, ps.thresholdString), ps.sum, "timer", e.Tags},
-		{fmt.Sprintf("%s.mean_%s", e.Name, ps.thresholdString), ps.mean, "timer", e.Tags},
-		{fmt.Sprintf("%s.upper_%s", e.Name, ps.thresholdString), ps.upper, "timer", e.Tags},
+		{Name: fmt.Sprintf("%s.sum_%s", e.Name, ps.thresholdString), Value: ps.sum, Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.mean_%s", e.Name, ps.thresholdString), Value: ps.mean, Type: "timer", Tags: e.Tags},
+		{Name: fmt.Sprintf("%s.upper_%s", e.Name, ps.thresholdString), Value: ps.upper, Type: "timer", Tags: e.Tags},
 	}
 }
 
+// Returns Prometheus style cumulative histogram buckets: for each bound in e.Buckets, the number
+// of values less than or equal to it, tagged le:<bound>, followed by the le:+Inf bucket of all values.
+func (e *Timing) BucketMetrics() []*Metric {
+	sorted := make(float64Slice, len(e.Values))
+	copy(sorted, e.Values)
+	sort.Sort(sorted)
+	metrics := make([]*Metric, 0, len(e.Buckets)+1)
+	name := fmt.Sprintf("%s.bucket", e.Name)
+	i := 0
+	for _, bound := range e.Buckets {
+		for i < len(sorted) && sorted[i] <= bound {
+			i++
+		}
+		le := "le:" + strconv.FormatFloat(bound, 'f', -1, 64)
+		metrics = append(metrics, &Metric{Name: name, Value: float64(i), Type: "histogram", Tags: appendTag(e.Tags, le)})
+	}
+	metrics = append(metrics, &Metric{Name: name, Value: float64(len(sorted)), Type: "histogram", Tags: appendTag(e.Tags, "le:+Inf")})
+	return metrics
+}
+
 // Update the event with metrics coming from a new one of the same type and with the same key
 func (e *Timing) Update(e2 Event) error {
 	if e.Type() != e2.Type() {
@@ -100,7 +137,6 @@ func (e *Timing) Update(e2 Event) error {
 		e.Max = maxFloat64(e.Max, p["max"])
 	}
 	e.Count += p["cnt"]
-	e.Tags = []string{}
 	return nil
 }
 
@@ -115,7 +151,7 @@ func (e *Timing) Reset() {
 
 // Return a copy of this Timing event
 func (e *Timing) Copy() Event {
-	e2 := &Timing{Name: e.Name, Min: e.Min, Max: e.Max, Value: e.Value, Values: e.Values, Count: e.Count, Tags: e.Tags}
+	e2 := &Timing{Name: e.Name, Min: e.Min, Max: e.Max, Value: e.Value, Values: e.Values, Count: e.Count, Tags: e.Tags, Buckets: e.Buckets, Stats: e.Stats, Percentiles: e.Percentiles}
 	return e2
 }
 
@@ -134,15 +170,24 @@ func (e Timing) Metrics() []*Metric {
 	if e.Count > 0 {
 		meanVal = float64(e.Value / e.Count) // make sure e.Count != 0
 	}
-	pctMetrics := e.PercentileMetrics(0.95)
-	metrics := []*Metric{
-		{fmt.Sprintf("%s.count", e.Name), e.Count, "timer", e.Tags},
-		{fmt.Sprintf("%s.sum", e.Name), e.Value, "timer", e.Tags},
-		{fmt.Sprintf("%s.mean", e.Name), meanVal, "timer", e.Tags},
-		{fmt.Sprintf("%s.min", e.Name), e.Min, "timer", e.Tags},
-		{fmt.Sprintf("%s.max", e.Name), e.Max, "timer", e.Tags},
+	values := map[string]float64{"count": e.Count, "sum": e.Value, "mean": meanVal, "min": e.Min, "max": e.Max}
+	stats, percentiles := e.Stats, e.Percentiles
+	if stats == nil {
+		stats = TimingStats
+	}
+	if percentiles == nil {
+		percentiles = []float64{0.95}
+	}
+	metrics := []*Metric{}
+	for _, stat := range stats {
+		metrics = append(metrics, &Metric{Name: fmt.Sprintf("%s.%s", e.Name, stat), Value: values[stat], Type: "timer", Tags: e.Tags})
+	}
+	for _, pct := range percentiles {
+		metrics = append(metrics, e.PercentileMetrics(pct)...)
+	}
+	if len(e.Buckets) > 0 {
+		metrics = append(metrics, e.BucketMetrics()...)
 	}
-	metrics = append(metrics, pctMetrics...)
 	return metrics
 }
 
@@ -156,6 +201,16 @@ func (e *Timing) SetKey(key string) {
 	e.Name = key
 }
 
+// GetTags returns the tags of this metric, in "key:value" form
+func (e Timing) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *Timing) SetTags(tags []string) {
+	e.Tags = tags
+}
+
 // Type returns an integer identifier for this type of metric
 func (e Timing) Type() int {
 	return EventTiming
@@ -171,6 +226,12 @@ func (e Timing) String() string {
 	return fmt.Sprintf("{Type: %s, Key: %s, Value: %+v}", e.TypeString(), e.Name, e.Payload())
 }
 
+// Returns a new slice of tags with tag appended, leaving tags itself untouched
+func appendTag(tags []string, tag string) []string {
+	t := make([]string, 0, len(tags)+1)
+	return append(append(t, tags...), tag)
+}
+
 func minFloat64(v1, v2 float64) float64 {
 	if v1 <= v2 {
 		return v1
@@ -1,6 +1,9 @@
 package event
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 //  Example Statsd percentile calculation of a timer
 //  timers: { mytimer: [ 0, 5, 10, 15, 20, 25, 30, 35, 40, 45, 50, 55, 60, 65, 70, 75, 80, 85, 90, 95 ] },
@@ -57,7 +60,7 @@ func TestPercentileAfterReset(t *testing.T) {
 	}
 }
 
-func TestUpdateAfterReset() {
+func TestUpdateAfterReset(t *testing.T) {
 	e := NewTiming("reset_timer", 1)
 	e.Reset()
 	for _, v := range []float64{5, 10} {
@@ -70,7 +73,7 @@ func TestUpdateAfterReset() {
 	if max := e.Max; 10 != max {
 		t.Errorf("Max: 10 != %v\n", max)
 	}
-	if value := e.Value; 5 != value {
+	if value := e.Value; 15 != value {
 		t.Errorf("Value: 15 != %v\n", value)
 	}
 	if count := e.Count; 2 != count {
@@ -120,4 +123,59 @@ func testStatsdPercentile20(t *testing.T, e *Timing) {
 	if metrics[2].Value != 85 {
 		t.Errorf("Percentile Metric Sum 85 != %v\n", metrics[2].Value)
 	}
-}
\ No newline at end of file
+}
+func TestTimingBuckets(t *testing.T) {
+	e := NewTiming("bucketed", 5)
+	for _, v := range []float64{1, 10, 50, 100, 500} {
+		e.Update(NewTiming("bucketed", v))
+	}
+	e.Buckets = []float64{5, 50, 100}
+	e.Tags = []string{"path:/"}
+	metrics := e.BucketMetrics()
+	expected := []struct {
+		le    string
+		count float64
+	}{{"le:5", 2}, {"le:50", 4}, {"le:100", 5}, {"le:+Inf", 6}}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Bucket metrics: %d != %d", len(expected), len(metrics))
+	}
+	for i, b := range expected {
+		m := metrics[i]
+		if m.Name != "bucketed.bucket" || m.Type != "histogram" {
+			t.Errorf("Bucket metric: bucketed.bucket histogram != %s %s", m.Name, m.Type)
+		}
+		if len(m.Tags) != 2 || m.Tags[0] != "path:/" || m.Tags[1] != b.le {
+			t.Errorf("Bucket tags: [path:/ %s] != %v", b.le, m.Tags)
+		}
+		if m.Value != b.count {
+			t.Errorf("Bucket %s: %v != %v", b.le, b.count, m.Value)
+		}
+	}
+	if len(e.Tags) != 1 {
+		t.Errorf("Timing tags modified by buckets: %v", e.Tags)
+	}
+	if e.Values[0] != 5 {
+		t.Errorf("Timing values reordered by buckets: %v", e.Values)
+	}
+}
+
+func TestTimingSelectedStats(t *testing.T) {
+	e := NewTiming("batch", 10)
+	e.Update(NewTiming("batch", 30))
+	e.Stats = []string{"mean", "max"}
+	e.Percentiles = []float64{0.999}
+	names := []string{}
+	for _, m := range e.Metrics() {
+		names = append(names, m.Name)
+	}
+	expected := []string{"batch.mean", "batch.max", "batch.sum_99_9", "batch.mean_99_9", "batch.upper_99_9"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Selected metrics: %v != %v", expected, names)
+	}
+
+	e.Stats = []string{}
+	e.Percentiles = []float64{}
+	if metrics := e.Metrics(); len(metrics) != 0 {
+		t.Errorf("Metrics with no stats selected: %v", metrics)
+	}
+}
@@ -0,0 +1,76 @@
+package event
+
+import "fmt"
+
+// Total is a counter that is summed and never reset, so it reports the running total
+// of every value received since scoutd started.
+type Total struct {
+	Name  string
+	Value float64
+	Tags  []string
+}
+
+// Update the event with metrics coming from a new one of the same type and with the same key
+func (e *Total) Update(e2 Event) error {
+	if e.Type() != e2.Type() {
+		return fmt.Errorf("statsd event type conflict: %s vs %s ", e.String(), e2.String())
+	}
+	e.Value += e2.Payload().(float64)
+	return nil
+}
+
+// Reset is a noop on Total events
+func (e *Total) Reset() {
+	return
+}
+
+func (e *Total) Copy() Event {
+	e2 := &Total{Name: e.Name, Value: e.Value, Tags: e.Tags}
+	return e2
+}
+
+// Payload returns the aggregated value for this event
+func (e Total) Payload() interface{} {
+	return e.Value
+}
+
+func (e Total) Metrics() []*Metric {
+	return []*Metric{
+		{Name: e.Name, Value: e.Value, Type: "total", Tags: e.Tags},
+	}
+}
+
+// Key returns the name of this metric
+func (e Total) Key() string {
+	return e.Name
+}
+
+// SetKey sets the name of this metric
+func (e *Total) SetKey(key string) {
+	e.Name = key
+}
+
+// GetTags returns the tags of this metric, in "key:value" form
+func (e Total) GetTags() []string {
+	return e.Tags
+}
+
+// SetTags sets the tags of this metric
+func (e *Total) SetTags(tags []string) {
+	e.Tags = tags
+}
+
+// Type returns an integer identifier for this type of metric
+func (e Total) Type() int {
+	return EventTotal
+}
+
+// TypeString returns a name for this type of metric
+func (e Total) TypeString() string {
+	return "Total"
+}
+
+// String returns a debug-friendly representation of this metric
+func (e Total) String() string {
+	return fmt.Sprintf("{Type: %s, Key: %s, Value: %f}", e.TypeString(), e.Name, e.Value)
+}
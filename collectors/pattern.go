@@ -0,0 +1,44 @@
+package collectors
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A pattern matched against metric names in the statsd configuration.
+// Patterns wrapped in slashes, eg: /^api\.(get|post)$/, are regular expressions.
+// Anything else is a glob, where "*" matches any run of characters (dots included)
+// and "?" matches any single character.
+type namePattern struct {
+	source string
+	re     *regexp.Regexp
+}
+
+func compilePattern(p string) (*namePattern, error) {
+	if p == "" {
+		return nil, fmt.Errorf("empty metric name pattern")
+	}
+	var expr string
+	if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+		expr = p[1 : len(p)-1]
+	} else {
+		expr = regexp.QuoteMeta(p)
+		expr = strings.Replace(expr, `\*`, ".*", -1)
+		expr = strings.Replace(expr, `\?`, ".", -1)
+		expr = "^" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric name pattern %q: %s", p, err)
+	}
+	return &namePattern{source: p, re: re}, nil
+}
+
+func (p *namePattern) match(name string) bool {
+	return p.re.MatchString(name)
+}
+
+func (p *namePattern) String() string {
+	return p.source
+}
@@ -1,19 +1,34 @@
 package collectors
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/pingdomserver/scoutd/collectors/event"
 	"io"
 	"log"
+	"math"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	DefaultStatsdAddr = "127.0.0.1:8125"
+	maxPacketSize     = 65535 // the largest UDP payload, and the longest line on a stream socket
+)
+
+// Policies for an event whose key is already used by an event of a different type
+const (
+	ConflictKeepFirst = "keep_first" // drop the new event
+	ConflictReplace   = "replace"    // replace the existing event with the new one
+	ConflictByType    = "by_type"    // aggregate events of each type separately
 )
 
 type StatsdCollector struct {
@@ -32,6 +47,43 @@ type StatsdCollector struct {
 	pktParseErrs   int64
 	pktReadErrs    int64
 	badPackets     int64
+	sources        *sourceTracker
+	topSources     int
+	rewriter       *rewriter
+	filter         *metricFilter
+	templates      nameTemplates
+	hostTags       []string
+	derived        []compiledDerivedMetric
+	derivedClashes map[string]bool // derived metric names already logged as colliding
+	counterRates   bool
+	cumulative     bool
+	conflictPolicy string
+	typeConflicts  map[string]int64
+	histograms     []histogramBuckets
+	overrides      []metricOverride
+	stateFile      string
+	gaugeMaxAge    time.Duration
+	gaugeUpdated   map[string]time.Time
+	closeChannel   chan chan error
+	flushChannel   chan chan bool
+	running        bool
+	runMutex       sync.Mutex // guards running, held while starting, flushing or stopping the aggregator
+	conn           net.PacketConn
+	listener       net.Listener
+	connMutex      sync.Mutex
+	capture        packetCapture
+	captureFile    string
+	subscribers    subscribers
+	relay          *relay
+	flushHook      func(*CollectorPayload)
+	samples        map[string]int64
+	windowStart    time.Time
+	lastSnapshot   *CollectorPayload // the last flush before a hot restart, see RestoredPayload()
+	snapshotWindow struct {
+		start   time.Time
+		end     time.Time
+		samples map[string]int64
+	}
 }
 
 // Initializes a new StatsdCollector. You must call Start() before this StatsdCollector will
@@ -50,10 +102,152 @@ func NewStatsdCollector(name string, addr string, flushInterval time.Duration, e
 		eventsSnapshot: make(map[string]event.Event, 0),
 		messageChannel: make(chan CollectorMessage, 10),
 		eventBlacklist: make(map[string]time.Time, 0),
+		conflictPolicy: ConflictKeepFirst,
+		typeConflicts:  make(map[string]int64),
+		samples:        make(map[string]int64),
+		windowStart:    time.Now(),
+		gaugeUpdated:   make(map[string]time.Time),
+		derivedClashes: make(map[string]bool),
+		closeChannel:   make(chan chan error),
+		flushChannel:   make(chan chan bool),
 	}
 	return sd, nil
 }
 
+// Enables per-source accounting of packets, lines and distinct metric names.
+// The topN busiest senders are reported on each flush. If rateLimit is above 0, each source
+// may send at most that many lines per second. If allow is not empty, only packets from
+// addresses within those networks (CIDR notation, or single addresses) are accepted, and from
+// the clients of a Unix socket only if it has a "unix" entry. Unix socket clients are all
+// reported as the source "unix".
+// Must be called before Start().
+func (sd *StatsdCollector) TrackSources(topN int, rateLimit float64, allow []string) error {
+	if topN < 0 {
+		return fmt.Errorf("invalid number of top sources to report: %d", topN)
+	}
+	st, err := newSourceTracker(rateLimit, allow)
+	if err != nil {
+		return err
+	}
+	sd.sources = st
+	sd.topSources = topN
+	return nil
+}
+
+// Sets the ordered list of rules used to rewrite metric names as events are aggregated.
+// Returns an error, and leaves the current rules in place, if any rule is invalid.
+// Must be called before Start().
+func (sd *StatsdCollector) SetRewriteRules(rules []RewriteRule) error {
+	rw, err := newRewriter(rules)
+	if err != nil {
+		return err
+	}
+	sd.rewriter = rw
+	return nil
+}
+
+// Sets static allow and deny lists of metric name patterns. Events are checked against them
+// as soon as they are parsed, before they reach the aggregator. See namePattern for the syntax.
+// Must be called before Start().
+func (sd *StatsdCollector) SetFilters(allow []string, deny []string) error {
+	if len(allow) == 0 && len(deny) == 0 {
+		sd.filter = nil
+		return nil
+	}
+	f, err := newMetricFilter(allow, deny)
+	if err != nil {
+		return err
+	}
+	sd.filter = f
+	return nil
+}
+
+// Sets the Graphite-style templates used to split dotted metric names into a base name and tags.
+// Templates are applied after the rewrite rules. See nameTemplate for the format.
+// Must be called before Start().
+func (sd *StatsdCollector) SetTemplates(templates []string) error {
+	ts, err := newNameTemplates(templates)
+	if err != nil {
+		return err
+	}
+	sd.templates = ts
+	return nil
+}
+
+// Sets tags that are appended to every metric in this collector's payload, such as the
+// hostname and environment. Must be called before Start().
+func (sd *StatsdCollector) SetHostTags(tags []string) {
+	sd.hostTags = tags
+}
+
+// Sets the metrics computed from each flushed snapshot. See DerivedMetric for the expression syntax.
+// Invalid derived metrics are left out, and listed in the error. Must be called before Start().
+func (sd *StatsdCollector) SetDerivedMetrics(metrics []DerivedMetric) error {
+	derived, err := compileDerivedMetrics(metrics)
+	sd.derived = derived
+	return err
+}
+
+// Sets what is reported for counters, in addition to the sum for the flush interval.
+// If rates is true, a per-second rate is reported as <name>.rate. If cumulative is true, a running
+// total that is never reset is reported as <name>.total. Must be called before Start().
+func (sd *StatsdCollector) SetCounterOptions(rates bool, cumulative bool) {
+	sd.counterRates = rates
+	sd.cumulative = cumulative
+}
+
+// Sets the histogram buckets reported for timers, by metric name pattern.
+// The first matching pattern is used. Must be called before Start().
+func (sd *StatsdCollector) SetHistograms(configs []HistogramConfig) error {
+	histograms, err := parseHistogramConfigs(configs)
+	if err != nil {
+		return err
+	}
+	sd.histograms = histograms
+	return nil
+}
+
+// Sets per-metric overrides of the statistics reported for timers and counters.
+// The first override whose pattern matches a metric name is used. Must be called before Start().
+func (sd *StatsdCollector) SetMetricOverrides(configs []MetricOverride) error {
+	overrides, err := parseMetricOverrides(configs)
+	if err != nil {
+		return err
+	}
+	sd.overrides = overrides
+	return nil
+}
+
+// Enables saving gauge values to the state file at path on every flush and on Shutdown().
+// Start() restores the saved gauges that were last updated within maxAge, or all of them
+// if maxAge is 0. Must be called before Start().
+func (sd *StatsdCollector) SetGaugePersistence(path string, maxAge time.Duration) {
+	sd.stateFile = path
+	sd.gaugeMaxAge = maxAge
+}
+
+// Sets a function that is given the payload of every flush. It is called from the aggregator,
+// so it must not block. Must be called before Start().
+func (sd *StatsdCollector) SetFlushHook(hook func(*CollectorPayload)) {
+	sd.flushHook = hook
+}
+
+// Sets what happens when an event arrives with the key of an event of a different type,
+// eg: "foo:1|c" followed by "foo:1|ms". One of ConflictKeepFirst (the default), ConflictReplace
+// or ConflictByType. Conflicts are counted per metric name whatever the policy.
+// Must be called before Start().
+func (sd *StatsdCollector) SetTypeConflictPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = ConflictKeepFirst
+	case ConflictKeepFirst, ConflictReplace, ConflictByType:
+	default:
+		return fmt.Errorf("unknown type conflict policy %q", policy)
+	}
+	sd.conflictPolicy = policy
+	return nil
+}
+
 // Starts the statsd aggregator and the UDP socket listener.
 // You must call Start() before this StatsdCollector will
 // begin listening for, and aggregating, statsd packets.
@@ -65,8 +259,73 @@ func (sd *StatsdCollector) Start() {
 		}
 	}()
 
+	if sd.stateFile != "" {
+		if n, err := sd.restoreGauges(); err != nil {
+			log.Printf("error restoring statsd gauges: %s", err)
+		} else if n > 0 {
+			log.Printf("restored %d statsd gauges from %s", n, sd.stateFile)
+		}
+	}
+	sd.startAggregator()
+	go func() {
+		if err := sd.ListenAndReceive(); err != nil {
+			log.Printf("error listening for statsd on %s: %s", sd.addr, err)
+		}
+	}()
+}
+
+// Starts the aggregator and accepts connections on l, rather than binding the configured address
+func (sd *StatsdCollector) StartListener(l net.Listener) {
+	sd.startAggregator()
+	go sd.ReceiveStream(l)
+}
+
+// Stops the aggregator, saving the gauge values if persistence is enabled.
+// Events received after Shutdown() are not aggregated.
+func (sd *StatsdCollector) Shutdown() error {
+	sd.stop()
+	sd.StopCapture()
+	if sd.relay != nil {
+		sd.relay.stop()
+	}
+	if sd.stateFile != "" {
+		return sd.saveGauges()
+	}
+	return nil
+}
+
+// Flushes the aggregated events into the payload now, rather than at the end of the flush
+// interval. The flush interval itself is not affected.
+func (sd *StatsdCollector) Flush() {
+	sd.runMutex.Lock()
+	defer sd.runMutex.Unlock()
+	if !sd.running {
+		sd.flush()
+		return
+	}
+	reply := make(chan bool)
+	sd.flushChannel <- reply
+	<-reply
+}
+
+func (sd *StatsdCollector) startAggregator() {
+	sd.runMutex.Lock()
+	defer sd.runMutex.Unlock()
+	sd.running = true
 	go sd.aggregate()
-	go sd.ListenAndReceive()
+}
+
+// Stops the aggregator after it has processed the events already queued, if it is running
+func (sd *StatsdCollector) stop() {
+	sd.runMutex.Lock()
+	defer sd.runMutex.Unlock()
+	if !sd.running {
+		return
+	}
+	sd.running = false
+	reply := make(chan error)
+	sd.closeChannel <- reply
+	<-reply
 }
 
 // The central aggregator for the StatsdCollector.
@@ -85,65 +344,240 @@ func (sd *StatsdCollector) aggregate() {
 	for {
 		select {
 		case <-flushTicker.C:
-			sd.eventsSnapshot = make(map[string]event.Event, len(sd.events))
-			for k, e := range sd.events {
-				if _, blacklisted := sd.eventBlacklist[k]; blacklisted {
-					continue // go to next event in for/range
-				}
-				sd.eventsSnapshot[k] = e.Copy()
-				switch e.Type() {
-				case event.EventIncr, event.EventTiming:
-					e.Reset()
-				}
-			}
-			if len(sd.eventsSnapshot) > 0 {
-				sd.eventsSnapshot["statsd.events_total"] = &event.Increment{Name: "statsd.events_total", Value: float64(len(sd.eventsSnapshot))}
-				sd.eventsSnapshot["statsd.events_received"] = &event.Increment{Name: "statsd.events_received", Value: float64(sd.eventsRcvd)}
-				// Disable reorting of these internal statsd metrics for now.
-				//sd.eventsSnapshot["statsd.events_dropped"] = &event.Increment{Name: "statsd.events_dropped", Value: float64(sd.eventsDropped)}
-				//sd.eventsSnapshot["statsd.packets_received"] = &event.Increment{Name: "statsd.packets_received", Value: float64(sd.pktsRcvd)}
-				//sd.eventsSnapshot["statsd.packet_read_errors"] = &event.Increment{Name: "statsd.packet_read_errors", Value: float64(sd.pktReadErrs)}
-				//sd.eventsSnapshot["statsd.packet_parse_errors"] = &event.Increment{Name: "statsd.packet_parse_errors", Value: float64(sd.pktParseErrs)}
-				//sd.eventsSnapshot["statsd.bad_packets"] = &event.Increment{Name: "statsd.bad_packets", Value: float64(sd.badPackets)}
-			}
-			sd.eventsRcvd = 0
-			sd.eventsDropped = 0
-			sd.pktsRcvd = 0
-			sd.pktParseErrs = 0
-			sd.pktReadErrs = 0
-			sd.badPackets = 0
-			sd.eventBlacklist = make(map[string]time.Time, 0)
+			sd.flush()
 		case e := <-sd.eventChannel:
-			sd.eventsRcvd += 1
-			// The events are stored in a map keyed by the metric name.
-			// Any operations on the metric namespace should be done here so that we update the
-			// correct event.
-			k := e.Key()
-			e.SetKey(k)
-
-			if _, blacklisted := sd.eventBlacklist[k]; blacklisted {
-				sd.eventsDropped += 1
-				break // break back to the "for" loop
+			sd.processEvent(e)
+		case msg := <-sd.messageChannel:
+			sd.processCollectorMessage(msg)
+		case reply := <-sd.flushChannel:
+			for len(sd.eventChannel) > 0 {
+				sd.processEvent(<-sd.eventChannel)
+			}
+			sd.flush()
+			reply <- true
+		case reply := <-sd.closeChannel:
+			flushTicker.Stop()
+			for len(sd.eventChannel) > 0 {
+				sd.processEvent(<-sd.eventChannel)
 			}
+			reply <- nil
+			return
+		}
+	}
+}
 
-			if e2, ok := sd.events[k]; ok {
-				// Update an existing event
-				e2.Update(e)
-				sd.events[k] = e2
-			} else {
-				if len(sd.events) < sd.eventLimit {
-					// Add a new event
-					sd.events[k] = e
-				} else {
-					sd.eventsDropped += 1
-				}
+// Snapshots sd.events into sd.eventsSnapshot and resets the per-interval counters.
+// Must only be called from aggregate().
+func (sd *StatsdCollector) flush() {
+	sd.flushAt(time.Now())
+}
+
+// Like flush(), with the flush window ending at now
+func (sd *StatsdCollector) flushAt(now time.Time) {
+	sd.snapshotWindow.start = sd.windowStart
+	sd.snapshotWindow.end = now
+	sd.snapshotWindow.samples = sd.samples
+	sd.samples = make(map[string]int64, len(sd.snapshotWindow.samples))
+	sd.windowStart = now
+	sd.eventsSnapshot = make(map[string]event.Event, len(sd.events))
+	for k, e := range sd.events {
+		if _, blacklisted := sd.eventBlacklist[e.Key()]; blacklisted {
+			continue // go to next event in for/range
+		}
+		sd.eventsSnapshot[k] = sd.applyMetricOptions(e.Copy())
+		switch e.Type() {
+		case event.EventIncr, event.EventTiming, event.EventAbsolute, event.EventFAbsolute, event.EventPrecisionTiming:
+			e.Reset()
+		}
+	}
+	if len(sd.eventsSnapshot) > 0 {
+		sd.eventsSnapshot["statsd.events_total"] = &event.Increment{Name: "statsd.events_total", Value: float64(len(sd.eventsSnapshot))}
+		sd.eventsSnapshot["statsd.events_received"] = &event.Increment{Name: "statsd.events_received", Value: float64(sd.eventsRcvd)}
+		// Disable reorting of these internal statsd metrics for now.
+		//sd.eventsSnapshot["statsd.events_dropped"] = &event.Increment{Name: "statsd.events_dropped", Value: float64(sd.eventsDropped)}
+		//sd.eventsSnapshot["statsd.packets_received"] = &event.Increment{Name: "statsd.packets_received", Value: float64(sd.pktsRcvd)}
+		//sd.eventsSnapshot["statsd.packet_read_errors"] = &event.Increment{Name: "statsd.packet_read_errors", Value: float64(sd.pktReadErrs)}
+		//sd.eventsSnapshot["statsd.packet_parse_errors"] = &event.Increment{Name: "statsd.packet_parse_errors", Value: float64(sd.pktParseErrs)}
+		//sd.eventsSnapshot["statsd.bad_packets"] = &event.Increment{Name: "statsd.bad_packets", Value: float64(sd.badPackets)}
+	}
+	if len(sd.derived) > 0 {
+		sd.snapshotDerived()
+	}
+	if sd.sources != nil {
+		sd.snapshotSources()
+	}
+	if sd.relay != nil {
+		sd.snapshotRelay()
+	}
+	if sd.filter != nil {
+		for rule, n := range sd.filter.dropCounts() {
+			sd.eventsSnapshot["statsd.filter_dropped|"+rule] = &event.Increment{Name: "statsd.filter_dropped", Value: float64(n), Tags: []string{"rule:" + rule}}
+		}
+	}
+	for name, n := range sd.typeConflicts {
+		sd.eventsSnapshot["statsd.type_conflicts|"+name] = &event.Increment{Name: "statsd.type_conflicts", Value: float64(n), Tags: []string{"metric:" + name}}
+	}
+	sd.typeConflicts = make(map[string]int64)
+	sd.eventsRcvd = 0
+	sd.eventsDropped = 0
+	// The packet counters are updated by the receiving goroutines
+	atomic.SwapInt64(&sd.pktsRcvd, 0)
+	atomic.SwapInt64(&sd.pktParseErrs, 0)
+	atomic.SwapInt64(&sd.pktReadErrs, 0)
+	atomic.SwapInt64(&sd.badPackets, 0)
+	sd.eventBlacklist = make(map[string]time.Time, 0)
+	if sd.stateFile != "" {
+		if err := sd.saveGauges(); err != nil {
+			log.Printf("error saving statsd gauges: %s", err)
+		}
+	}
+	if sd.flushHook != nil {
+		sd.flushHook(sd.Payload())
+	}
+}
+
+// Adds a single parsed event to sd.events, updating the existing event of the same key.
+// Must only be called from aggregate().
+func (sd *StatsdCollector) processEvent(e event.Event) {
+	sd.eventsRcvd += 1
+	// The events are stored in a map keyed by the metric name and tags.
+	// Any operations on the metric namespace should be done here so that we update the
+	// correct event.
+	name := e.Key()
+	if sd.rewriter != nil {
+		var keep bool
+		if name, keep = sd.rewriter.rewrite(name); !keep {
+			sd.eventsDropped += 1
+			return
+		}
+	}
+	if len(sd.templates) > 0 {
+		var tags []string
+		if name, tags = sd.templates.apply(name); len(tags) > 0 {
+			e.SetTags(append(tags, e.GetTags()...))
+		}
+	}
+	e.SetKey(name)
+
+	if _, blacklisted := sd.eventBlacklist[name]; blacklisted {
+		sd.eventsDropped += 1
+		return
+	}
+
+	sd.publish(e)
+	k := eventKey(name, e.GetTags())
+
+	if err := sd.storeEvent(k, e); err != nil {
+		// The same key was already used by an event of another type
+		sd.typeConflicts[name] += 1
+		switch sd.conflictPolicy {
+		case ConflictReplace:
+			sd.events[k] = e
+			sd.samples[k] = 1
+			delete(sd.gaugeUpdated, k)
+			if isGauge(e) {
+				sd.gaugeUpdated[k] = time.Now()
 			}
-		case msg := <-sd.messageChannel:
-			sd.processCollectorMessage(msg)
-			//case c := <-sb.closeChannel:
-			//	Flush before closing
-			//	c.reply <- sb.flush()
-			//	return
+		case ConflictByType:
+			sd.storeEvent(k+"#"+e.TypeString(), e)
+		default:
+			sd.eventsDropped += 1
+		}
+	}
+}
+
+// Adds e to sd.events under key k, or updates the existing event of that key.
+// Returns an error, leaving the existing event untouched, if it is of a different type.
+func (sd *StatsdCollector) storeEvent(k string, e event.Event) error {
+	if e2, ok := sd.events[k]; ok {
+		// Update an existing event
+		if err := e2.Update(e); err != nil {
+			return err
+		}
+		sd.events[k] = e2
+	} else {
+		if len(sd.events) < sd.eventLimit {
+			// Add a new event
+			sd.events[k] = e
+		} else {
+			sd.eventsDropped += 1
+			return nil
+		}
+	}
+	sd.samples[k] += 1
+	if isGauge(e) {
+		sd.gaugeUpdated[k] = time.Now()
+	}
+	return nil
+}
+
+// Configures what a snapshotted event reports from its Metrics()
+func (sd *StatsdCollector) applyMetricOptions(e event.Event) event.Event {
+	// Rates are over the window actually flushed, which differs from the flush interval for the
+	// first window after a hot restart, or a flush on demand
+	interval := sd.snapshotWindow.end.Sub(sd.snapshotWindow.start).Seconds()
+	if interval <= 0 {
+		interval = sd.flushInterval.Seconds()
+	}
+	switch e := e.(type) {
+	case *event.Increment:
+		if sd.counterRates {
+			e.Interval = interval
+		}
+		e.Cumulative = sd.cumulative
+	case *event.Timing:
+		if len(sd.histograms) > 0 {
+			e.Buckets = findHistogramBuckets(sd.histograms, e.Key())
+		}
+	}
+	if len(sd.overrides) > 0 {
+		if o := findMetricOverride(sd.overrides, e.Key()); o != nil {
+			o.apply(e, interval)
+		}
+	}
+	return e
+}
+
+// Evaluates the derived metrics over the metrics in sd.eventsSnapshot, and adds the results to it.
+// Series of the same name with different tags are summed.
+func (sd *StatsdCollector) snapshotDerived() {
+	values := make(map[string]float64)
+	keys := make(map[string]bool, len(sd.eventsSnapshot)) // eg: a timer, whose metrics have suffixes
+	for k, e := range sd.eventsSnapshot {
+		keys[k] = true
+		for _, m := range e.Metrics() {
+			values[m.Name] += m.Value
+		}
+	}
+	results, collisions := evalDerivedMetrics(sd.derived, values, keys)
+	for name, v := range results {
+		sd.eventsSnapshot[name] = &event.Gauge{Name: name, Value: v}
+	}
+	for _, name := range collisions {
+		if !sd.derivedClashes[name] {
+			log.Printf("statsd derived metric %s is not computed, as a metric of that name was received", name)
+			sd.derivedClashes[name] = true
+		}
+	}
+}
+
+// Adds the per-source accounting for the busiest senders to sd.eventsSnapshot.
+// Each metric is tagged with the source address, so the snapshot keys include it to stay unique.
+func (sd *StatsdCollector) snapshotSources() {
+	top, denied := sd.sources.flush(sd.topSources)
+	if denied > 0 {
+		sd.eventsSnapshot["statsd.source_denied"] = &event.Increment{Name: "statsd.source_denied", Value: float64(denied)}
+	}
+	for _, s := range top {
+		tags := []string{"source:" + s.addr}
+		values := map[string]int64{
+			"statsd.source.packets": s.packets,
+			"statsd.source.lines":   s.lines,
+			"statsd.source.metrics": int64(len(s.names)),
+			"statsd.source.limited": s.limited,
+		}
+		for name, v := range values {
+			sd.eventsSnapshot[name+"|"+s.addr] = &event.Increment{Name: name, Value: float64(v), Tags: tags}
 		}
 	}
 }
@@ -153,43 +587,132 @@ func (sd *StatsdCollector) Collect() error {
 	return nil
 }
 
-// Set up the UDP listener socket, pass conn to sd.Receive()
+// Set up the listener socket for sd.addr, and pass it to sd.Receive() or sd.ReceiveStream().
+// The address may start with the network: udp:// (the default), tcp://, unix:// for a Unix
+// stream socket or unixgram:// for a Unix datagram socket, eg: unix:///var/run/scoutd.sock
 func (sd *StatsdCollector) ListenAndReceive() error {
 	addr := sd.addr
 	if addr == "" {
 		addr = DefaultStatsdAddr
 	}
-	conn, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		return err
+	network, address := splitListenAddr(addr)
+	switch network {
+	case "unix", "unixgram":
+		os.Remove(address) // a socket file left behind by a previous run
 	}
-	return sd.Receive(conn)
+	switch network {
+	case "udp", "unixgram":
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			return err
+		}
+		return sd.Receive(conn)
+	case "tcp", "unix":
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		return sd.ReceiveStream(l)
+	}
+	return fmt.Errorf("unsupported statsd network %q", network)
+}
+
+// Splits an address like tcp://127.0.0.1:8125 into its network and address. Addresses
+// without a network are udp.
+func splitListenAddr(addr string) (string, string) {
+	if i := strings.Index(addr, "://"); i > 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "udp", addr
 }
 
 // Handles the reading of the UDP packet. Sends the contents of the UDP packet to sd.handleMessage()
+// Returns once conn is closed.
 func (sd *StatsdCollector) Receive(conn net.PacketConn) error {
 	defer conn.Close()
+	sd.connMutex.Lock()
+	sd.conn = conn
+	sd.connMutex.Unlock()
 
-	msg := make([]byte, 1024)
+	msg := make([]byte, maxPacketSize)
 	for {
 		nbytes, addr, err := conn.ReadFrom(msg)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			log.Printf("%s", err)
-			sd.pktReadErrs += 1
+			atomic.AddInt64(&sd.pktReadErrs, 1)
 			continue
 		}
+		if addr == nil {
+			addr = conn.LocalAddr() // a Unix datagram from an unbound socket
+		}
 		buf := make([]byte, nbytes)
 		copy(buf, msg[:nbytes])
-		sd.pktsRcvd += 1
+		sd.capture.record(addr, buf)
+		atomic.AddInt64(&sd.pktsRcvd, 1)
 		go sd.handleMessage(addr, buf)
 	}
 	panic("error reading from udp socket")
 }
 
+// Accepts connections on a stream socket, and handles each line received on them like a
+// UDP packet. Returns once l is closed.
+func (sd *StatsdCollector) ReceiveStream(l net.Listener) error {
+	defer l.Close()
+	sd.connMutex.Lock()
+	sd.listener = l
+	sd.connMutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("%s", err)
+			atomic.AddInt64(&sd.pktReadErrs, 1)
+			time.Sleep(100 * time.Millisecond) // eg: out of file descriptors
+			continue
+		}
+		go sd.receiveLines(conn)
+	}
+}
+
+func (sd *StatsdCollector) receiveLines(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), maxPacketSize)
+	for scanner.Scan() {
+		buf := make([]byte, len(scanner.Bytes()))
+		copy(buf, scanner.Bytes())
+		sd.capture.record(addr, buf)
+		atomic.AddInt64(&sd.pktsRcvd, 1)
+		sd.handleMessage(addr, buf)
+	}
+	if err := scanner.Err(); err != nil {
+		atomic.AddInt64(&sd.pktReadErrs, 1)
+	}
+}
+
 // Handles the contents of a message received from Receive()
 // Reads each line of the message and sends to parseLine()
 // On parseLine() success, we get beck an event.Event and send it to sd.eventChannel
 func (sd *StatsdCollector) handleMessage(addr net.Addr, msg []byte) {
+	for _, e := range sd.parseMessage(addr, msg, time.Now()) {
+		sd.eventChannel <- e
+	}
+}
+
+// Parses each line of a message received at now, returning the events that pass the source and
+// name filters. Parsing stops at the first invalid line.
+func (sd *StatsdCollector) parseMessage(addr net.Addr, msg []byte, now time.Time) []event.Event {
+	events := []event.Event{}
+	if sd.sources != nil && !sd.sources.permitPacket(addr) {
+		return events // source is not in the allowlist
+	}
 	buf := bytes.NewBuffer(msg)
 	for {
 		line, readerr := buf.ReadBytes('\n')
@@ -197,8 +720,8 @@ func (sd *StatsdCollector) handleMessage(addr net.Addr, msg []byte) {
 		// protocol does not require line to end in \n, if EOF use received line if valid
 		if readerr != nil && readerr != io.EOF {
 			//log.Printf("error reading message from %s: %s", addr, readerr)
-			sd.badPackets += 1
-			return
+			atomic.AddInt64(&sd.badPackets, 1)
+			return events
 		} else if readerr != io.EOF {
 			// remove newline, only if not EOF
 			if len(line) > 0 {
@@ -212,18 +735,41 @@ func (sd *StatsdCollector) handleMessage(addr net.Addr, msg []byte) {
 			if err != nil {
 				// Log the error
 				//fmt.Printf("Parsing error: %s", err)
-				sd.pktParseErrs += 1
-				return
+				atomic.AddInt64(&sd.pktParseErrs, 1)
+				return events
+			}
+			if sd.admitEvent(addr, evnt, now) {
+				events = append(events, evnt)
+				if sd.relay != nil {
+					sd.relay.forward(evnt.Key(), line)
+				}
 			}
-			sd.eventChannel <- evnt
 		}
 
 		if readerr == io.EOF {
-			return // done with this message
+			return events // done with this message
 		}
 	}
 }
 
+// Reports whether a parsed event, received at now, should be passed on to the aggregator
+func (sd *StatsdCollector) admitEvent(addr net.Addr, e event.Event, now time.Time) bool {
+	if sd.sources != nil && !sd.sources.permitLine(addr, e.Key(), now) {
+		return false // source is over its rate limit
+	}
+	if sd.filter != nil && !sd.filter.permit(e.Key()) {
+		return false // metric is filtered out
+	}
+	return true
+}
+
+// Parses a single line in statsd protocol format, without its newline, exactly as the collector
+// does. Surrounding whitespace, such as the \r of a \r\n line ending, makes the line invalid.
+// For tools that validate or send statsd lines.
+func ParseLine(line string) (event.Event, error) {
+	return parseLine([]byte(line))
+}
+
 // Parses a single line in statsd protocol format and returns an event.Event
 func parseLine(line []byte) (event.Event, error) {
 	var err error
@@ -254,6 +800,7 @@ func parseLine(line []byte) (event.Event, error) {
 
 	var sampleRate float64
 	sampleRate = 1.0
+	var tags []string
 
 	if len(s) > 2 {
 		for _, fieldBytes := range s[2:] {
@@ -264,6 +811,13 @@ func parseLine(line []byte) (event.Event, error) {
 					if rateValue > 0.0 && rateValue <= 1.0 {
 						sampleRate = rateValue
 					}
+				case "#":
+					// DogStatsD style tags: #key:value,othertag
+					for _, tag := range bytes.Split(fieldBytes[1:], []byte(",")) {
+						if len(tag) > 0 {
+							tags = append(tags, string(tag))
+						}
+					}
 				}
 			}
 		}
@@ -281,10 +835,35 @@ func parseLine(line []byte) (event.Event, error) {
 	case "c":
 		// Counter
 		evnt = &event.Increment{Name: name, Value: float64(value), SampleRate: sampleRate}
+	case "a":
+		// Absolute counter, integer values only
+		if value != math.Trunc(value) {
+			return nil, fmt.Errorf("error parsing metric: absolute value must be an integer")
+		}
+		evnt = &event.Absolute{Name: name, Value: int64(value)}
+	case "fa":
+		// Floating point absolute counter
+		evnt = &event.FAbsolute{Name: name, Value: value}
+	case "t":
+		// Total, a counter that is never reset
+		evnt = &event.Total{Name: name, Value: value}
+	case "fg":
+		// Floating point gauge. A leading sign makes it an adjustment of the current value
+		if sign := nameAndVal[valIndex+1]; sign == '+' || sign == '-' {
+			evnt = &event.FGaugeDelta{Name: name, Value: value}
+		} else {
+			evnt = &event.FGauge{Name: name, Value: value}
+		}
+	case "pt":
+		// Precision timer, in milliseconds
+		evnt = event.NewPrecisionTiming(name, time.Duration(value*float64(time.Millisecond)))
 	default:
 		err = fmt.Errorf("invalid metric type: %q", typeString)
 		return nil, err
 	}
+	if tags != nil {
+		evnt.SetTags(tags)
+	}
 
 	return evnt, nil
 }
@@ -293,11 +872,21 @@ func parseLine(line []byte) (event.Event, error) {
 // Returns a pointer to a CollectorPayload to prevent copy overhead
 func (sd *StatsdCollector) Payload() *CollectorPayload {
 	metrics := []*event.Metric{}
+	window := sd.snapshotWindow
 	for k, e := range sd.eventsSnapshot {
-		if _, blacklisted := sd.eventBlacklist[k]; blacklisted {
+		if _, blacklisted := sd.eventBlacklist[e.Key()]; blacklisted {
 			continue // go to next event in for/range
 		}
 		for _, m := range e.Metrics() {
+			m.WindowStart = window.start.Unix()
+			m.WindowEnd = window.end.Unix()
+			m.Interval = window.end.Sub(window.start).Seconds()
+			m.Samples = window.samples[k]
+			if len(sd.hostTags) > 0 {
+				// Copy so the appended tags never end up in the event's own slice
+				tags := make([]string, 0, len(m.Tags)+len(sd.hostTags))
+				m.Tags = append(append(tags, m.Tags...), sd.hostTags...)
+			}
 			metrics = append(metrics, m)
 		}
 	}
@@ -320,7 +909,12 @@ func (sd *StatsdCollector) processCollectorMessage(msg CollectorMessage) {
 		now := time.Now()
 		for _, name := range metricNames {
 			sd.eventBlacklist[name] = now.UTC()
-			delete(sd.events, name)
+		}
+		// Events are keyed by name and tags, so remove every tagged variant of each name
+		for k, e := range sd.events {
+			if _, blacklisted := sd.eventBlacklist[e.Key()]; blacklisted {
+				delete(sd.events, k)
+			}
 		}
 	}
 }
@@ -329,6 +923,18 @@ func (sd *StatsdCollector) ReceiveCollectorMessage(msg CollectorMessage) {
 	switch msg.MessageType {
 	case "delete_metrics":
 		sd.messageChannel <- msg
+	case "start_capture":
+		// Does not touch the aggregator state, so it is handled right away
+		var opts struct {
+			Duration int `json:"duration"` // seconds
+		}
+		if err := json.Unmarshal(msg.Data, &opts); err != nil {
+			log.Printf("Error unmarshalling capture options: %s\n", err)
+			return
+		}
+		if err := sd.StartCapture(time.Duration(opts.Duration) * time.Second); err != nil {
+			log.Printf("Error starting statsd capture: %s\n", err)
+		}
 	}
 }
 
@@ -0,0 +1,145 @@
+package collectors
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The longest a capture may run, so a forgotten capture does not fill the disk
+const MaxCaptureDuration = time.Hour
+
+// A raw statsd packet, as written to a capture file, one JSON object per line
+type captureRecord struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Data   string    `json:"data"`
+}
+
+// Records the raw packets received by the collector to a file, for a bounded duration.
+// record() is called from Receive(), while start() and stop() may be called from any goroutine.
+type packetCapture struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	timer   *time.Timer
+	packets int64
+}
+
+func (c *packetCapture) start(path string, duration time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file != nil {
+		return fmt.Errorf("a capture to %s is already running", c.file.Name())
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	c.file = f
+	c.writer = bufio.NewWriter(f)
+	c.encoder = json.NewEncoder(c.writer)
+	c.packets = 0
+	c.timer = time.AfterFunc(duration, func() { c.stop() })
+	return nil
+}
+
+// Ends the capture, if one is running, and returns the number of packets recorded
+func (c *packetCapture) stop() (int64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return 0, nil
+	}
+	c.timer.Stop()
+	err := c.writer.Flush()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	c.file = nil
+	return c.packets, err
+}
+
+func (c *packetCapture) record(addr net.Addr, msg []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.file == nil {
+		return
+	}
+	source := ""
+	if addr != nil {
+		source = addr.String()
+	}
+	if err := c.encoder.Encode(captureRecord{Time: time.Now(), Source: source, Data: string(msg)}); err == nil {
+		c.packets++
+	}
+}
+
+// Sets the file that StartCapture() writes to
+func (sd *StatsdCollector) SetCaptureFile(path string) {
+	sd.captureFile = path
+}
+
+// Starts recording every packet received, with the time and source address, to the capture
+// file for the given duration. A later capture overwrites the file.
+func (sd *StatsdCollector) StartCapture(duration time.Duration) error {
+	if sd.captureFile == "" {
+		return fmt.Errorf("no statsd capture file configured")
+	}
+	if duration <= 0 || duration > MaxCaptureDuration {
+		return fmt.Errorf("capture duration must be above 0 and at most %s", MaxCaptureDuration)
+	}
+	if err := sd.capture.start(sd.captureFile, duration); err != nil {
+		return err
+	}
+	log.Printf("capturing statsd packets to %s for %s", sd.captureFile, duration)
+	return nil
+}
+
+// Ends a running capture early
+func (sd *StatsdCollector) StopCapture() error {
+	_, err := sd.capture.stop()
+	return err
+}
+
+// Feeds the packets in a capture file through the parser and the aggregator, as if they were
+// received at the times they were captured, and returns the payload of a single flush covering
+// the whole capture.
+// The collector's rewrite rules, filters and other settings apply, so the collector should be
+// configured like the one that made the capture. Must not be used on a started collector.
+func (sd *StatsdCollector) Replay(r io.Reader) (*CollectorPayload, error) {
+	decoder := json.NewDecoder(r)
+	var first, last time.Time
+	for {
+		var rec captureRecord
+		if err := decoder.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid capture record: %s", err)
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		last = rec.Time
+		var addr net.Addr
+		if udpAddr, err := net.ResolveUDPAddr("udp", rec.Source); err == nil {
+			addr = udpAddr
+		}
+		// The rate limit applies as it did when the packet was captured
+		for _, e := range sd.parseMessage(addr, []byte(rec.Data), rec.Time) {
+			sd.processEvent(e)
+		}
+	}
+	if !first.IsZero() {
+		sd.windowStart = first
+	}
+	sd.flushAt(last)
+	return sd.Payload(), nil
+}
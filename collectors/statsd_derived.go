@@ -0,0 +1,347 @@
+package collectors
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A metric computed at flush time from the other metrics in the snapshot,
+// as configured in the statsd.derived_metrics section of scoutd.yml.
+//
+// Expressions support numbers, metric names, + - * / and parentheses, as well as the
+// functions sum, avg, min, max and count, which take a glob of metric names:
+//
+//	app.errors / app.requests * 100
+//	sum(db.*.queries)
+//
+// Metric names may contain "-" and "*", so subtraction and multiplication must be written
+// with spaces around them.
+// A name refers to the total of all series with that name, whatever their tags.
+// Derived metrics are evaluated in order, so they may refer to the ones defined before them.
+// A derived metric is left out of the payload when a metric it uses is missing, on
+// division by zero, or when a real metric has the same name.
+type DerivedMetric struct {
+	Name string
+	Expr string
+}
+
+type compiledDerivedMetric struct {
+	name string
+	expr exprNode
+}
+
+// Parses the derived metrics, returning the valid ones, and an error listing the invalid ones
+func compileDerivedMetrics(metrics []DerivedMetric) ([]compiledDerivedMetric, error) {
+	compiled := make([]compiledDerivedMetric, 0, len(metrics))
+	errs := []string{}
+	for _, m := range metrics {
+		if m.Name == "" {
+			errs = append(errs, fmt.Sprintf("derived metric %q: name is required", m.Expr))
+			continue
+		}
+		expr, err := parseExpr(m.Expr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("derived metric %s: %s", m.Name, err))
+			continue
+		}
+		compiled = append(compiled, compiledDerivedMetric{name: m.Name, expr: expr})
+	}
+	if len(errs) > 0 {
+		return compiled, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return compiled, nil
+}
+
+// Checks the derived metric definitions without using them, so configuration errors can be
+// reported as soon as the config file is loaded.
+func ValidateDerivedMetrics(metrics []DerivedMetric) error {
+	_, err := compileDerivedMetrics(metrics)
+	return err
+}
+
+type exprNode interface {
+	eval(values map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(values map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type metricNode string
+
+func (n metricNode) eval(values map[string]float64) (float64, error) {
+	v, ok := values[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("no metric %s", string(n))
+	}
+	return v, nil
+}
+
+type negateNode struct {
+	x exprNode
+}
+
+func (n negateNode) eval(values map[string]float64) (float64, error) {
+	v, err := n.x.eval(values)
+	return -v, err
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n binaryNode) eval(values map[string]float64) (float64, error) {
+	l, err := n.left.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(values)
+	if err != nil {
+		return 0, err
+	}
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	}
+	if r == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	return l / r, nil
+}
+
+type aggregateNode struct {
+	fn      string
+	pattern *namePattern
+}
+
+func (n aggregateNode) eval(values map[string]float64) (float64, error) {
+	var count, sum float64
+	min, max := math.Inf(1), math.Inf(-1)
+	for name, v := range values {
+		if !n.pattern.match(name) {
+			continue
+		}
+		count++
+		sum += v
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	switch n.fn {
+	case "count":
+		return count, nil
+	case "sum":
+		return sum, nil
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no metrics match %s", n.pattern)
+	}
+	switch n.fn {
+	case "avg":
+		return sum / count, nil
+	case "min":
+		return min, nil
+	}
+	return max, nil
+}
+
+// A recursive descent parser for derived metric expressions:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | function "(" glob ")" | "(" expr ")"
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseExpr(s string) (exprNode, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == '*' || c == '?' || c == '-'
+}
+
+func tokenizeExpr(s string) ([]string, error) {
+	tokens := []string{}
+	// A "*" is a multiplication when it follows an operand, otherwise it starts a glob
+	afterOperand := func() bool {
+		if len(tokens) == 0 {
+			return false
+		}
+		last := tokens[len(tokens)-1]
+		return len(last) > 1 || strings.IndexByte("+-*/(", last[0]) < 0
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("+-/()", c) >= 0, c == '*' && afterOperand():
+			tokens = append(tokens, string(c))
+			i++
+		case isNameChar(c):
+			start := i
+			for i < len(s) && isNameChar(s[i]) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expr() (exprNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()[0]
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) term() (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" {
+		op := p.next()[0]
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if p.peek() == "-" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negateNode{x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	t := p.next()
+	switch t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return x, nil
+	case ")", "+", "*", "/":
+		return nil, fmt.Errorf("unexpected %q", t)
+	}
+	if c := t[0]; c >= '0' && c <= '9' || c == '.' {
+		if v, err := strconv.ParseFloat(t, 64); err == nil {
+			return numberNode(v), nil
+		}
+	}
+	if p.peek() == "(" {
+		switch t {
+		case "sum", "avg", "min", "max", "count":
+		default:
+			return nil, fmt.Errorf("unknown function %s", t)
+		}
+		p.next()
+		glob := p.next()
+		if glob == "" || !isNameChar(glob[0]) {
+			return nil, fmt.Errorf("%s() needs a metric name pattern", t)
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ) after %s(%s", t, glob)
+		}
+		pattern, err := compilePattern(glob)
+		if err != nil {
+			return nil, err
+		}
+		return aggregateNode{fn: t, pattern: pattern}, nil
+	}
+	if strings.ContainsAny(t, "*?") {
+		return nil, fmt.Errorf("pattern %s can only be used inside sum, avg, min, max or count", t)
+	}
+	return metricNode(t), nil
+}
+
+// Evaluates the derived metrics over the metrics in the snapshot, returning the value of each
+// one that could be computed, keyed by name. A derived metric is not computed when its name is
+// already used by a real metric, the key of a snapshotted event (in taken), or an earlier derived
+// metric; those names are returned as collisions.
+func evalDerivedMetrics(derived []compiledDerivedMetric, values map[string]float64, taken map[string]bool) (map[string]float64, []string) {
+	results := make(map[string]float64, len(derived))
+	collisions := []string{}
+	for _, d := range derived {
+		if _, exists := values[d.name]; exists || taken[d.name] {
+			collisions = append(collisions, d.name)
+			continue
+		}
+		v, err := d.expr.eval(values)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		results[d.name] = v
+		values[d.name] = v
+	}
+	return results, collisions
+}
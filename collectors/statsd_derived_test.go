@@ -0,0 +1,153 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func TestDerivedExpressions(t *testing.T) {
+	values := map[string]float64{
+		"app.errors":        5,
+		"app.requests":      200,
+		"db.users.queries":  10,
+		"db.orders.queries": 30,
+		"api-gateway.hits":  7,
+		"zero":              0,
+	}
+	tests := map[string]float64{
+		"app.errors / app.requests":         0.025,
+		"app.errors / app.requests * 100":   2.5,
+		"(app.errors + 5) * 2":              20,
+		"app.requests - app.errors - 5":     190,
+		"-app.errors + 10":                  5,
+		"sum(db.*.queries)":                 40,
+		"avg(db.*.queries)":                 20,
+		"min(db.*.queries)":                 10,
+		"max(db.*.queries)":                 30,
+		"count(db.*.queries)":               2,
+		"sum(*.queries) / count(*.queries)": 20,
+		"api-gateway.hits * 2":              14,
+		"sum(nothing.*) + count(nothing.*)": 0,
+		"1.5e2 / 3":                         50,
+	}
+	for expr, expected := range tests {
+		node, err := parseExpr(expr)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", expr, err)
+			continue
+		}
+		v, err := node.eval(values)
+		if err != nil {
+			t.Errorf("Error evaluating %q: %s", expr, err)
+		} else if v != expected {
+			t.Errorf("%s: %v != %v", expr, expected, v)
+		}
+	}
+
+	for _, expr := range []string{"app.errors / zero", "missing.metric + 1", "avg(nothing.*)"} {
+		node, err := parseExpr(expr)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", expr, err)
+			continue
+		}
+		if _, err := node.eval(values); err == nil {
+			t.Errorf("No error evaluating %q", expr)
+		}
+	}
+}
+
+func TestDerivedValidation(t *testing.T) {
+	invalid := []DerivedMetric{
+		{Name: "", Expr: "a + b"},
+		{Name: "empty", Expr: ""},
+		{Name: "unbalanced", Expr: "(a + b"},
+		{Name: "trailing", Expr: "a +"},
+		{Name: "glob", Expr: "db.*.queries"},
+		{Name: "function", Expr: "median(db.*)"},
+		{Name: "character", Expr: "a % b"},
+		{Name: "operator", Expr: "a * / b"},
+	}
+	for _, d := range invalid {
+		if err := ValidateDerivedMetrics([]DerivedMetric{d}); err == nil {
+			t.Errorf("No error on invalid derived metric %s: %q", d.Name, d.Expr)
+		}
+	}
+}
+
+func TestDerivedSnapshot(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	err := sd.SetDerivedMetrics([]DerivedMetric{
+		{Name: "app.error_ratio", Expr: "app.errors / app.requests"},
+		{Name: "app.error_pct", Expr: "app.error_ratio * 100"},
+		{Name: "app.latency_ratio", Expr: "app.latency.max / app.latency.mean"},
+		{Name: "app.missing", Expr: "app.nothing / app.requests"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"app.errors:1|c", "app.requests:3|c|#path:/", "app.requests:1|c|#path:/login", "app.latency:10|ms", "app.latency:30|ms"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	expected := map[string]float64{"app.error_ratio": 0.25, "app.error_pct": 25, "app.latency_ratio": 1.5}
+	for name, v := range expected {
+		e, ok := sd.eventsSnapshot[name]
+		if !ok {
+			t.Errorf("Derived metric %s missing from snapshot", name)
+		} else if e.Payload() != v {
+			t.Errorf("Derived metric %s: %v != %v", name, v, e.Payload())
+		}
+	}
+	if _, ok := sd.eventsSnapshot["app.missing"]; ok {
+		t.Errorf("Derived metric with a missing input was reported")
+	}
+}
+
+func TestDerivedInvalidLeftOut(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	err := sd.SetDerivedMetrics([]DerivedMetric{
+		{Name: "app.bad", Expr: "app.errors /"},
+		{Name: "app.double", Expr: "app.errors * 2"},
+	})
+	if err == nil {
+		t.Errorf("No error for an invalid derived metric")
+	}
+	e, _ := parseLine([]byte("app.errors:2|c"))
+	sd.processEvent(e)
+	sd.flush()
+	if e, ok := sd.eventsSnapshot["app.double"]; !ok || e.Payload() != 4.0 {
+		t.Errorf("Valid derived metric alongside an invalid one: 4 != %v", e)
+	}
+}
+
+func TestDerivedNameCollision(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	err := sd.SetDerivedMetrics([]DerivedMetric{
+		{Name: "app.requests", Expr: "app.errors * 100"},
+		{Name: "app.latency.max", Expr: "app.errors"},
+		{Name: "app.latency", Expr: "app.errors"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"app.errors:1|c", "app.requests:3|c", "app.latency:10|ms"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	if e := sd.eventsSnapshot["app.requests"]; e.Payload() != 3.0 {
+		t.Errorf("Derived metric replaced the real app.requests: 3 != %v", e.Payload())
+	}
+	if _, ok := sd.eventsSnapshot["app.latency.max"]; ok {
+		t.Errorf("Derived metric named like a timer statistic was reported")
+	}
+	if _, ok := sd.eventsSnapshot["app.latency"].(*event.Timing); !ok {
+		t.Errorf("Derived metric replaced the app.latency timer: %v", sd.eventsSnapshot["app.latency"])
+	}
+	if !sd.derivedClashes["app.latency"] {
+		t.Errorf("Derived metric named like a timer was not logged as colliding")
+	}
+}
@@ -0,0 +1,75 @@
+package collectors
+
+import (
+	"sync/atomic"
+)
+
+// A single allow or deny pattern, and how many events it has dropped this flush interval
+type filterRule struct {
+	pattern *namePattern
+	dropped int64
+}
+
+// Static allow and deny lists for statsd metric names.
+// The deny list is evaluated first. If the allow list is not empty, names that match none of
+// its patterns are dropped as well. Drop counts are kept per rule and updated atomically,
+// since handleMessage() runs in its own goroutine for every packet.
+type metricFilter struct {
+	allow      []*filterRule
+	deny       []*filterRule
+	notAllowed int64
+}
+
+func newMetricFilter(allow []string, deny []string) (*metricFilter, error) {
+	f := &metricFilter{}
+	for _, p := range allow {
+		pattern, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, &filterRule{pattern: pattern})
+	}
+	for _, p := range deny {
+		pattern, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, &filterRule{pattern: pattern})
+	}
+	return f, nil
+}
+
+// Returns false if the metric name should be dropped
+func (f *metricFilter) permit(name string) bool {
+	for _, rule := range f.deny {
+		if rule.pattern.match(name) {
+			atomic.AddInt64(&rule.dropped, 1)
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, rule := range f.allow {
+		if rule.pattern.match(name) {
+			return true
+		}
+	}
+	atomic.AddInt64(&f.notAllowed, 1)
+	return false
+}
+
+// Returns the number of events dropped by each rule since the last call, keyed by a
+// description of the rule. Rules that dropped nothing are left out.
+func (f *metricFilter) dropCounts() map[string]int64 {
+	counts := make(map[string]int64)
+	for _, rule := range f.deny {
+		if n := atomic.SwapInt64(&rule.dropped, 0); n > 0 {
+			counts["deny:"+rule.pattern.String()] = n
+		}
+	}
+	if n := atomic.SwapInt64(&f.notAllowed, 0); n > 0 {
+		counts["not_allowed"] = n
+	}
+	return counts
+}
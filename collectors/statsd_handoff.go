@@ -0,0 +1,235 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// The aggregation state passed from a running scoutd to its replacement on a hot restart,
+// so the current flush window is not lost.
+type statsdState struct {
+	WindowStart  int64             `json:"window_start"` // unix nanoseconds
+	Events       []savedEvent      `json:"events"`
+	Samples      map[string]int64  `json:"samples"`
+	GaugeUpdated map[string]int64  `json:"gauge_updated"`      // unix seconds
+	Snapshot     *CollectorPayload `json:"snapshot,omitempty"` // the payload of the last flush
+}
+
+// An event of any type, with its key in sd.events
+type savedEvent struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"` // the event's TypeString()
+	Event json.RawMessage `json:"event"`
+}
+
+// Returns an empty event for a TypeString(), to decode a savedEvent into
+func newEventOfType(typeString string) (event.Event, error) {
+	switch typeString {
+	case "Increment":
+		return &event.Increment{}, nil
+	case "Gauge":
+		return &event.Gauge{}, nil
+	case "Timing":
+		return &event.Timing{}, nil
+	case "Absolute":
+		return &event.Absolute{}, nil
+	case "FAbsolute":
+		return &event.FAbsolute{}, nil
+	case "Total":
+		return &event.Total{}, nil
+	case "FGauge":
+		return &event.FGauge{}, nil
+	case "FGaugeDelta":
+		return &event.FGaugeDelta{}, nil
+	case "PrecisionTiming":
+		return &event.PrecisionTiming{}, nil
+	}
+	return nil, fmt.Errorf("unknown event type %s", typeString)
+}
+
+// Serializes sd.events and the current flush window.
+// Must only be called while the aggregator is stopped.
+func (sd *StatsdCollector) marshalState() ([]byte, error) {
+	state := statsdState{
+		WindowStart:  sd.windowStart.UnixNano(),
+		Events:       make([]savedEvent, 0, len(sd.events)),
+		Samples:      sd.samples,
+		GaugeUpdated: make(map[string]int64, len(sd.gaugeUpdated)),
+	}
+	for k, e := range sd.events {
+		js, err := json.Marshal(e)
+		if err != nil { // eg: a NaN gauge
+			log.Printf("statsd event %s is not handed off: %s", k, err)
+			continue
+		}
+		state.Events = append(state.Events, savedEvent{Key: k, Type: e.TypeString(), Event: js})
+	}
+	for k, updated := range sd.gaugeUpdated {
+		state.GaugeUpdated[k] = updated.Unix()
+	}
+	if !sd.snapshotWindow.end.IsZero() {
+		state.Snapshot = finitePayload(sd.Payload())
+	} else {
+		state.Snapshot = sd.lastSnapshot // not flushed since the last hot restart
+	}
+	return json.Marshal(state)
+}
+
+// Restores sd.events and the flush window from the output of marshalState().
+// Must be called before the aggregator is started.
+func (sd *StatsdCollector) unmarshalState(js []byte) error {
+	var state statsdState
+	if err := json.Unmarshal(js, &state); err != nil {
+		return err
+	}
+	events := make(map[string]event.Event, len(state.Events))
+	for _, saved := range state.Events {
+		e, err := newEventOfType(saved.Type)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(saved.Event, e); err != nil {
+			return fmt.Errorf("invalid %s event %s: %s", saved.Type, saved.Key, err)
+		}
+		events[saved.Key] = e
+	}
+	sd.events = events
+	sd.windowStart = time.Unix(0, state.WindowStart)
+	if state.Samples != nil {
+		sd.samples = state.Samples
+	}
+	sd.gaugeUpdated = make(map[string]time.Time, len(state.GaugeUpdated))
+	for k, updated := range state.GaugeUpdated {
+		sd.gaugeUpdated[k] = time.Unix(updated, 0)
+	}
+	sd.lastSnapshot = state.Snapshot
+	return nil
+}
+
+// Returns p without the metrics json can't encode: NaN and infinite values
+func finitePayload(p *CollectorPayload) *CollectorPayload {
+	metrics := make([]*event.Metric, 0, len(p.Metrics))
+	for _, m := range p.Metrics {
+		if !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0) {
+			metrics = append(metrics, m)
+		}
+	}
+	p.Metrics = metrics
+	return p
+}
+
+// Returns the payload of the last flush before a hot restart, restored by StartWith(), or nil.
+// It is not passed to the flush hook, so it can be published only where it is still missing,
+// rather than reported twice.
+func (sd *StatsdCollector) RestoredPayload() *CollectorPayload {
+	return sd.lastSnapshot
+}
+
+// Stops receiving and aggregating events for a hot restart. Returns a duplicate of the listening
+// socket and the serialized aggregation state, to be passed to the new scoutd process and given
+// to its TakeOver(). Packets and connections that arrive in the meantime are queued by the kernel,
+// while connections already accepted are dropped once this process is replaced.
+// If the new process fails to take over, TakeOver(f, nil) resumes this collector. On error,
+// the collector keeps running.
+func (sd *StatsdCollector) Handoff() (*os.File, []byte, error) {
+	sd.connMutex.Lock()
+	conn, listener := sd.conn, sd.listener
+	sd.connMutex.Unlock()
+	var socket io.Closer
+	switch {
+	case conn != nil:
+		socket = conn
+	case listener != nil:
+		socket = listener
+		if ul, ok := listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false) // the new process keeps using the socket file
+		}
+	default:
+		return nil, nil, fmt.Errorf("statsd is not listening")
+	}
+	filer, ok := socket.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, nil, fmt.Errorf("statsd socket %T can't be handed off", socket)
+	}
+	f, err := filer.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	socket.Close() // Receive() or ReceiveStream() returns, the duplicate in f keeps the socket open
+	sd.stop()
+	sd.StopCapture()
+	state, err := sd.marshalState()
+	if err != nil {
+		sd.TakeOver(f, nil)
+		f.Close()
+		return nil, nil, err
+	}
+	return f, state, nil
+}
+
+// Completes a hot restart once the new process has the socket and state from Handoff(), by
+// sending the lines still queued for the relay upstreams. Unlike Shutdown(), the gauges are not
+// saved, as the new process restores them from the handed off state, and owns the state file.
+func (sd *StatsdCollector) FinishHandoff() {
+	if sd.relay != nil {
+		sd.relay.stop()
+	}
+}
+
+// Starts the aggregator and receives packets from conn, which was handed off by another scoutd
+// process, instead of binding a new socket. The aggregation state from Handoff() is restored
+// first, unless state is nil.
+func (sd *StatsdCollector) StartWith(conn net.PacketConn, state []byte) error {
+	if err := sd.restoreState(state); err != nil {
+		return err
+	}
+	sd.startAggregator()
+	go sd.Receive(conn)
+	return nil
+}
+
+// Like StartWith(), for a socket handed off by Handoff(), which may be a datagram socket or a
+// stream listener. f can be closed once TakeOver() returns.
+func (sd *StatsdCollector) TakeOver(f *os.File, state []byte) error {
+	sotype, err := syscall.GetsockoptInt(int(f.Fd()), syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return err
+	}
+	if err := sd.restoreState(state); err != nil {
+		return err
+	}
+	if sotype == syscall.SOCK_STREAM {
+		l, err := net.FileListener(f)
+		if err != nil {
+			return err
+		}
+		sd.StartListener(l)
+		return nil
+	}
+	conn, err := net.FilePacketConn(f)
+	if err != nil {
+		return err
+	}
+	return sd.StartWith(conn, nil)
+}
+
+func (sd *StatsdCollector) restoreState(state []byte) error {
+	if state == nil {
+		return nil
+	}
+	if err := sd.unmarshalState(state); err != nil {
+		return fmt.Errorf("error restoring statsd state: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package collectors
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Histogram buckets for the timers matching a metric name pattern, as configured in the
+// statsd.histograms section of scoutd.yml. Either Buckets or Exponential must be set.
+type HistogramConfig struct {
+	Match       string // Metric name pattern, see namePattern
+	Buckets     string // Comma separated bucket upper bounds, eg: "5,10,25,50,100"
+	Exponential string // "start,factor,count", eg: "1,2,10" for the bounds 1, 2, 4 ... 512
+}
+
+type histogramBuckets struct {
+	pattern *namePattern
+	bounds  []float64
+}
+
+func parseHistogramConfigs(configs []HistogramConfig) ([]histogramBuckets, error) {
+	histograms := make([]histogramBuckets, 0, len(configs))
+	for _, c := range configs {
+		pattern, err := compilePattern(c.Match)
+		if err != nil {
+			return nil, fmt.Errorf("histogram %q: %s", c.Match, err)
+		}
+		var bounds []float64
+		switch {
+		case c.Buckets != "" && c.Exponential != "":
+			return nil, fmt.Errorf("histogram %s: only one of buckets or exponential may be set", c.Match)
+		case c.Buckets != "":
+			bounds, err = parseFloatList(c.Buckets)
+		case c.Exponential != "":
+			bounds, err = exponentialBuckets(c.Exponential)
+		default:
+			err = fmt.Errorf("buckets or exponential is required")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("histogram %s: %s", c.Match, err)
+		}
+		sort.Float64s(bounds)
+		histograms = append(histograms, histogramBuckets{pattern: pattern, bounds: bounds})
+	}
+	return histograms, nil
+}
+
+func parseFloatList(s string) ([]float64, error) {
+	values := []float64{}
+	for _, item := range strings.Split(s, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", item)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// Returns count bounds, starting at start and each one factor times the previous
+func exponentialBuckets(s string) ([]float64, error) {
+	params, err := parseFloatList(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(params) != 3 {
+		return nil, fmt.Errorf("exponential must be start,factor,count")
+	}
+	start, factor, count := params[0], params[1], int(params[2])
+	if start <= 0 || factor <= 1 || count < 1 || count > 100 {
+		return nil, fmt.Errorf("exponential needs start > 0, factor > 1 and 1 to 100 buckets")
+	}
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds, nil
+}
+
+// Returns the bucket bounds of the first histogram config matching name, or nil
+func findHistogramBuckets(histograms []histogramBuckets, name string) []float64 {
+	for _, h := range histograms {
+		if h.pattern.match(name) {
+			return h.bounds
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package collectors
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// Overrides for the metrics matching a name pattern, as configured in the statsd.overrides
+// section of scoutd.yml. Empty fields keep the collector wide setting.
+type MetricOverride struct {
+	Match        string // Metric name pattern, see namePattern
+	Stats        string // Comma separated timer statistics to report, out of count, sum, mean, min and max. "none" for none
+	Percentiles  string // Comma separated timer percentiles to report, eg: "95,99,99.9". "none" for none
+	CounterRates string // "true" or "false", whether counters report a per-second rate
+	Cumulative   string // "true" or "false", whether counters report a running total
+}
+
+type metricOverride struct {
+	pattern      *namePattern
+	stats        []string
+	percentiles  []float64
+	counterRates *bool
+	cumulative   *bool
+}
+
+func parseMetricOverrides(configs []MetricOverride) ([]metricOverride, error) {
+	overrides := make([]metricOverride, 0, len(configs))
+	for _, c := range configs {
+		o, err := parseMetricOverride(c)
+		if err != nil {
+			return nil, fmt.Errorf("override %q: %s", c.Match, err)
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, nil
+}
+
+func parseMetricOverride(c MetricOverride) (metricOverride, error) {
+	o := metricOverride{}
+	pattern, err := compilePattern(c.Match)
+	if err != nil {
+		return o, err
+	}
+	o.pattern = pattern
+	if c.Stats != "" {
+		o.stats = []string{}
+		if c.Stats != "none" {
+			for _, stat := range strings.Split(c.Stats, ",") {
+				stat = strings.TrimSpace(stat)
+				if !validTimingStat(stat) {
+					return o, fmt.Errorf("unknown timer statistic %q", stat)
+				}
+				o.stats = append(o.stats, stat)
+			}
+		}
+	}
+	if c.Percentiles != "" {
+		o.percentiles = []float64{}
+		if c.Percentiles != "none" {
+			pcts, err := parseFloatList(c.Percentiles)
+			if err != nil {
+				return o, err
+			}
+			for _, pct := range pcts {
+				if pct <= 0 || pct > 100 {
+					return o, fmt.Errorf("percentile %v is not between 0 and 100", pct)
+				}
+				o.percentiles = append(o.percentiles, pct/100)
+			}
+		}
+	}
+	if o.counterRates, err = parseOptionalBool(c.CounterRates); err != nil {
+		return o, err
+	}
+	if o.cumulative, err = parseOptionalBool(c.Cumulative); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+func validTimingStat(stat string) bool {
+	for _, s := range event.TimingStats {
+		if s == stat {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns nil for an empty string, so unset options can be told apart from false ones
+func parseOptionalBool(s string) (*bool, error) {
+	var b bool
+	switch s {
+	case "":
+		return nil, nil
+	case "true":
+		b = true
+	case "false":
+	default:
+		return nil, fmt.Errorf("%q is not true or false", s)
+	}
+	return &b, nil
+}
+
+// Returns the first override matching name, or nil
+func findMetricOverride(overrides []metricOverride, name string) *metricOverride {
+	for i := range overrides {
+		if overrides[i].pattern.match(name) {
+			return &overrides[i]
+		}
+	}
+	return nil
+}
+
+// Applies the override's settings to a copy of an event in the snapshot
+func (o *metricOverride) apply(e event.Event, interval float64) {
+	switch e := e.(type) {
+	case *event.Increment:
+		if o.counterRates != nil {
+			e.Interval = 0
+			if *o.counterRates {
+				e.Interval = interval
+			}
+		}
+		if o.cumulative != nil {
+			e.Cumulative = *o.cumulative
+		}
+	case *event.Timing:
+		if o.stats != nil {
+			e.Stats = o.stats
+		}
+		if o.percentiles != nil {
+			e.Percentiles = o.percentiles
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package collectors
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingdomserver/scoutd/client"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+const (
+	DefaultRelayBuffer = 10000 // lines queued per upstream before lines are dropped
+	relayReplicas      = 100   // points on the hash ring per upstream
+)
+
+// How long stopping the relay waits for the upstreams to send their queued lines
+var relayStopTimeout = 10 * time.Second
+
+// A consistent hash ring of upstreams. Each upstream owns relayReplicas points on the ring,
+// and a metric name goes to the owner of the first point at or after its hash, so adding or
+// removing an upstream only moves the names it owns.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]int
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newHashRing(names []string) *hashRing {
+	r := &hashRing{owners: make(map[uint32]int, len(names)*relayReplicas)}
+	for i, name := range names {
+		for j := 0; j < relayReplicas; j++ {
+			point := hash32(name + "#" + strconv.Itoa(j))
+			if _, taken := r.owners[point]; taken {
+				continue // a collision, the first owner keeps it
+			}
+			r.owners[point] = i
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Returns the index of the upstream that owns key
+func (r *hashRing) get(key string) int {
+	h := hash32(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// An upstream statsd server that lines are repeated to. Lines are queued, and sent by their
+// own goroutine, so a slow upstream drops lines instead of slowing down the collector.
+type relayUpstream struct {
+	addr    string
+	client  *client.Client
+	lines   chan string
+	done    chan bool
+	sent    int64
+	dropped int64
+	errors  int64
+}
+
+func (u *relayUpstream) run() {
+	defer close(u.done)
+	for line := range u.lines {
+		if err := u.client.SendLine(line); err != nil {
+			atomic.AddInt64(&u.errors, 1)
+		} else {
+			atomic.AddInt64(&u.sent, 1)
+		}
+	}
+	u.client.Close()
+}
+
+// Repeats the raw lines received by the collector to one or more upstream statsd servers,
+// picking the upstream for each line by consistent hashing of the metric name, so each
+// upstream aggregates all the lines of the metrics it owns.
+type relay struct {
+	mutex     sync.RWMutex // held for writing only by stop()
+	upstreams []*relayUpstream
+	ring      *hashRing
+	patterns  []*namePattern
+	stopped   bool
+}
+
+func newRelay(upstreams []string, match []string, buffer int) (*relay, error) {
+	if buffer <= 0 {
+		buffer = DefaultRelayBuffer
+	}
+	r := &relay{ring: newHashRing(upstreams)}
+	for _, p := range match {
+		pattern, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, pattern)
+	}
+	for _, addr := range upstreams {
+		u := &relayUpstream{addr: addr, lines: make(chan string, buffer), done: make(chan bool)}
+		c, err := client.New(addr)
+		if err != nil {
+			// An upstream that is down now may be up later: the client connects on each flush
+			log.Printf("statsd relay upstream %s: %s", addr, err)
+			u.errors += 1
+			c, err = client.NewUnconnected(addr, client.DefaultFlushInterval)
+		}
+		if err != nil {
+			r.stop()
+			return nil, fmt.Errorf("relay upstream %s: %s", addr, err)
+		}
+		u.client = c
+		go u.run()
+		r.upstreams = append(r.upstreams, u)
+	}
+	return r, nil
+}
+
+// Queues line for the upstream that owns name, if name matches the relay patterns.
+// Called from handleMessage(), in a goroutine per packet.
+func (r *relay) forward(name string, line []byte) {
+	if len(r.patterns) > 0 {
+		matched := false
+		for _, p := range r.patterns {
+			if p.match(name) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return
+		}
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.stopped {
+		return
+	}
+	u := r.upstreams[r.ring.get(name)]
+	select {
+	case u.lines <- string(line):
+	default:
+		atomic.AddInt64(&u.dropped, 1)
+	}
+}
+
+// Sends the queued lines and closes the upstream connections, giving up on the upstreams that
+// have not finished within relayStopTimeout
+func (r *relay) stop() {
+	r.mutex.Lock()
+	if r.stopped {
+		r.mutex.Unlock()
+		return
+	}
+	r.stopped = true
+	r.mutex.Unlock()
+	for _, u := range r.upstreams {
+		close(u.lines)
+	}
+	expired := make(chan bool)
+	timer := time.AfterFunc(relayStopTimeout, func() { close(expired) })
+	defer timer.Stop()
+	for _, u := range r.upstreams {
+		select {
+		case <-u.done:
+		case <-expired:
+			log.Printf("statsd relay upstream %s: gave up sending %d queued lines", u.addr, len(u.lines))
+		}
+	}
+}
+
+// Sets the upstream statsd servers that valid lines are repeated to, as well as being
+// aggregated locally. If match is not empty, only lines for metric names matching one of its
+// patterns are repeated. Each upstream queues up to buffer lines, or DefaultRelayBuffer if
+// buffer is 0. Addresses are in the format of client.New(). Must be called before Start().
+func (sd *StatsdCollector) SetRelay(upstreams []string, match []string, buffer int) error {
+	if len(upstreams) == 0 {
+		sd.relay = nil
+		return nil
+	}
+	r, err := newRelay(upstreams, match, buffer)
+	if err != nil {
+		return err
+	}
+	sd.relay = r
+	return nil
+}
+
+// Adds the lines sent, dropped and failed per upstream since the last flush to sd.eventsSnapshot
+func (sd *StatsdCollector) snapshotRelay() {
+	for _, u := range sd.relay.upstreams {
+		tags := []string{"upstream:" + u.addr}
+		values := map[string]int64{
+			"statsd.relay.sent":    atomic.SwapInt64(&u.sent, 0),
+			"statsd.relay.dropped": atomic.SwapInt64(&u.dropped, 0),
+			"statsd.relay.errors":  atomic.SwapInt64(&u.errors, 0),
+		}
+		for name, v := range values {
+			sd.eventsSnapshot[name+"|"+u.addr] = &event.Increment{Name: name, Value: float64(v), Tags: tags}
+		}
+	}
+}
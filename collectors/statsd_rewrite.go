@@ -0,0 +1,112 @@
+package collectors
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Metric name rewrite rule types
+const (
+	RewriteRename   = "rename"
+	RewritePrefix   = "prefix"
+	RewriteSuffix   = "suffix"
+	RewriteSanitize = "sanitize"
+	RewriteDrop     = "drop"
+)
+
+// A single metric name rewrite rule, as configured in the statsd section of scoutd.yml.
+// Rules are applied in order, each one to the result of the previous.
+type RewriteRule struct {
+	Type    string // One of rename, prefix, suffix, sanitize or drop
+	Match   string // Regular expression matched against the name by rename and drop rules
+	Replace string // Replacement for rename rules. May reference capture groups, eg: ${1}
+	Value   string // The string added by prefix and suffix rules
+}
+
+type compiledRewriteRule struct {
+	RewriteRule
+	re *regexp.Regexp
+}
+
+// Applies an ordered list of RewriteRules to metric names
+type rewriter struct {
+	rules []compiledRewriteRule
+}
+
+func newRewriter(rules []RewriteRule) (*rewriter, error) {
+	rw := &rewriter{}
+	for i, rule := range rules {
+		c := compiledRewriteRule{RewriteRule: rule}
+		switch rule.Type {
+		case RewriteRename, RewriteDrop:
+			if rule.Match == "" {
+				return nil, fmt.Errorf("rewrite rule %d (%s): match is required", i, rule.Type)
+			}
+			re, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite rule %d (%s): invalid match: %s", i, rule.Type, err)
+			}
+			c.re = re
+		case RewritePrefix, RewriteSuffix:
+			if rule.Value == "" {
+				return nil, fmt.Errorf("rewrite rule %d (%s): value is required", i, rule.Type)
+			}
+		case RewriteSanitize:
+		default:
+			return nil, fmt.Errorf("rewrite rule %d: unknown type %q", i, rule.Type)
+		}
+		rw.rules = append(rw.rules, c)
+	}
+	return rw, nil
+}
+
+// Returns the rewritten name, and false if the metric should be dropped
+func (rw *rewriter) rewrite(name string) (string, bool) {
+	for _, rule := range rw.rules {
+		switch rule.Type {
+		case RewriteRename:
+			name = rule.re.ReplaceAllString(name, rule.Replace)
+		case RewritePrefix:
+			name = rule.Value + name
+		case RewriteSuffix:
+			name = name + rule.Value
+		case RewriteSanitize:
+			name = sanitizeName(name)
+		case RewriteDrop:
+			if rule.re.MatchString(name) {
+				return "", false
+			}
+		}
+	}
+	if name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// Makes a metric name safe for any backend, following the Etsy statsd conventions:
+// runs of whitespace become "_", "/" becomes "-" and anything else outside of
+// [A-Za-z0-9_.-], including all non-ASCII characters, is removed.
+func sanitizeName(name string) string {
+	var b strings.Builder
+	inSpace := false
+	for _, r := range name {
+		if unicode.IsSpace(r) {
+			if !inSpace {
+				b.WriteByte('_')
+			}
+			inSpace = true
+			continue
+		}
+		inSpace = false
+		switch {
+		case r == '/':
+			b.WriteByte('-')
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,98 @@
+package collectors
+
+import (
+	"testing"
+	"time"
+)
+
+func testRewrite(t *testing.T, rules []RewriteRule, name string, expected string, keep bool) {
+	rw, err := newRewriter(rules)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	rewritten, ok := rw.rewrite(name)
+	if ok != keep {
+		t.Errorf("Rewrite of %q kept: %v != %v", name, keep, ok)
+	}
+	if rewritten != expected {
+		t.Errorf("Rewrite of %q: %q != %q", name, expected, rewritten)
+	}
+}
+
+func TestRewriteRename(t *testing.T) {
+	rules := []RewriteRule{{Type: RewriteRename, Match: `^app\.timers\.(.*)$`, Replace: "app.${1}"}}
+	testRewrite(t, rules, "app.timers.request", "app.request", true)
+	testRewrite(t, rules, "other.timers.request", "other.timers.request", true)
+}
+
+func TestRewritePrefixSuffix(t *testing.T) {
+	rules := []RewriteRule{
+		{Type: RewritePrefix, Value: "prod."},
+		{Type: RewriteSuffix, Value: ".web"},
+	}
+	testRewrite(t, rules, "requests", "prod.requests.web", true)
+}
+
+func TestRewriteSanitize(t *testing.T) {
+	rules := []RewriteRule{{Type: RewriteSanitize}}
+	testRewrite(t, rules, "my  metric/name", "my_metric-name", true)
+	testRewrite(t, rules, "café.lätency", "caf.ltency", true)
+	testRewrite(t, rules, "weird!@#chars", "weirdchars", true)
+	testRewrite(t, rules, "éé", "", false)
+}
+
+func TestRewriteDrop(t *testing.T) {
+	rules := []RewriteRule{
+		{Type: RewritePrefix, Value: "app."},
+		{Type: RewriteDrop, Match: `^app\.debug\.`},
+	}
+	testRewrite(t, rules, "debug.timer", "", false)
+	testRewrite(t, rules, "request.timer", "app.request.timer", true)
+}
+
+func TestRewriteInvalidRules(t *testing.T) {
+	invalid := [][]RewriteRule{
+		{{Type: "uppercase"}},
+		{{Type: RewriteRename}},
+		{{Type: RewriteRename, Match: "("}},
+		{{Type: RewriteDrop}},
+		{{Type: RewritePrefix}},
+		{{Type: RewriteSuffix}},
+	}
+	for _, rules := range invalid {
+		if _, err := newRewriter(rules); err == nil {
+			t.Errorf("No error on invalid rule: %+v", rules[0])
+		}
+	}
+}
+
+func TestRewriteAggregation(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	err := sd.SetRewriteRules([]RewriteRule{
+		{Type: RewriteSanitize},
+		{Type: RewriteDrop, Match: `^ignored\.`},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"my counter:1|c", "my_counter:2|c", "ignored.counter:1|c"} {
+		e, err := parseLine([]byte(line))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		sd.processEvent(e)
+	}
+	if len(sd.events) != 1 {
+		t.Fatalf("Events after rewrite: 1 != %d", len(sd.events))
+	}
+	e, ok := sd.events["my_counter"]
+	if !ok {
+		t.Fatalf("Rewritten event my_counter missing: %v", sd.events)
+	}
+	if 3.0 != e.Payload() {
+		t.Errorf("Rewritten event value: 3 != %v", e.Payload())
+	}
+	if e.Key() != "my_counter" {
+		t.Errorf("Rewritten event name: my_counter != %s", e.Key())
+	}
+}
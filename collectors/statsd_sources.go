@@ -0,0 +1,207 @@
+package collectors
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of distinct metric names remembered per source in each flush interval.
+// A source sending more names than this is still counted, but its name count stops growing.
+const maxSourceNames = 10000
+
+// Per-source accounting for a single sender address over one flush interval
+type sourceStats struct {
+	addr     string
+	packets  int64
+	lines    int64
+	limited  int64
+	names    map[string]struct{}
+	tokens   float64
+	lastFill time.Time
+}
+
+// Tracks packets, lines and distinct metric names per source address.
+// Optionally enforces an allowlist of networks and a per-source line rate limit.
+// handleMessage() runs in its own goroutine for every packet, so all access is locked.
+type sourceTracker struct {
+	mu        sync.Mutex
+	allow     []*net.IPNet
+	allowUnix bool    // the allowlist has a "unix" entry
+	rateLimit float64 // lines per second per source, 0 for no limit
+	sources   map[string]*sourceStats
+	denied    int64
+}
+
+func newSourceTracker(rateLimit float64, allow []string) (*sourceTracker, error) {
+	st := &sourceTracker{
+		rateLimit: rateLimit,
+		sources:   make(map[string]*sourceStats),
+	}
+	for _, a := range allow {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		if a == unixSource {
+			st.allowUnix = true
+			continue
+		}
+		if !strings.Contains(a, "/") {
+			// A bare address is a network of one
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a = a + "/32"
+			} else {
+				a = a + "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source allowlist entry %q: %s", a, err)
+		}
+		st.allow = append(st.allow, network)
+	}
+	return st, nil
+}
+
+// The source of everything received on a Unix socket. Unix socket clients are rarely bound to
+// a path of their own, so all of them are one source.
+const unixSource = "unix"
+
+// Returns the IP portion of addr, which is what sources are keyed by.
+// The source port changes with every client socket, so it is not useful for attribution.
+func sourceIP(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return unixSource
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Reports whether ip is covered by the allowlist. An empty allowlist allows everything.
+// Unix socket clients are only allowed by a "unix" entry.
+func (st *sourceTracker) allowed(ip string) bool {
+	if len(st.allow) == 0 && !st.allowUnix {
+		return true
+	}
+	if ip == unixSource {
+		return st.allowUnix
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range st.allow {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Must be called with st.mu held
+func (st *sourceTracker) stats(ip string, now time.Time) *sourceStats {
+	s, ok := st.sources[ip]
+	if !ok {
+		s = &sourceStats{
+			addr:     ip,
+			names:    make(map[string]struct{}),
+			tokens:   st.rateLimit,
+			lastFill: now,
+		}
+		st.sources[ip] = s
+	}
+	return s
+}
+
+// Counts a packet from addr. Returns false if the source is not allowed to send to us.
+func (st *sourceTracker) permitPacket(addr net.Addr) bool {
+	ip := sourceIP(addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.allowed(ip) {
+		st.denied += 1
+		return false
+	}
+	st.stats(ip, time.Now()).packets += 1
+	return true
+}
+
+// Counts a parsed line from addr, received at now. Returns false if the source has exceeded its
+// rate limit, in which case the line should be dropped.
+func (st *sourceTracker) permitLine(addr net.Addr, name string, now time.Time) bool {
+	ip := sourceIP(addr)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s := st.stats(ip, now)
+	s.lines += 1
+	if len(s.names) < maxSourceNames {
+		s.names[name] = struct{}{}
+	}
+	if st.rateLimit <= 0 {
+		return true
+	}
+	// Token bucket refilled at rateLimit per second, allowing bursts of up to one second's worth
+	s.tokens += now.Sub(s.lastFill).Seconds() * st.rateLimit
+	if s.tokens > st.rateLimit {
+		s.tokens = st.rateLimit
+	}
+	s.lastFill = now
+	if s.tokens < 1 {
+		s.limited += 1
+		return false
+	}
+	s.tokens -= 1
+	return true
+}
+
+// Returns the accounting for the n sources that sent the most lines, and the number of packets
+// denied by the allowlist. Resets the per-interval counters.
+func (st *sourceTracker) flush(n int) ([]sourceStats, int64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	all := make([]sourceStats, 0, len(st.sources))
+	for _, s := range st.sources {
+		all = append(all, *s)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].lines != all[j].lines {
+			return all[i].lines > all[j].lines
+		}
+		return all[i].addr < all[j].addr
+	})
+	if n < 0 {
+		n = 0
+	}
+	if n < len(all) {
+		all = all[:n]
+	}
+	denied := st.denied
+	st.denied = 0
+	// Keep the token buckets between intervals so that a flush does not reset a source's limit
+	for ip, s := range st.sources {
+		if s.lines == 0 && s.packets == 0 {
+			delete(st.sources, ip)
+			continue
+		}
+		s.packets = 0
+		s.lines = 0
+		s.limited = 0
+		s.names = make(map[string]struct{})
+	}
+	return all, denied
+}
@@ -0,0 +1,114 @@
+package collectors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// The version of the gauge state file format
+const gaugeStateVersion = 1
+
+// The gauge values saved to the state file, so they survive a restart of scoutd.
+// Apps usually only send a gauge when it changes, so without them every restart would leave
+// those gauges blank until the next change.
+type gaugeStateFile struct {
+	Version int          `json:"version"`
+	Saved   int64        `json:"saved"` // unix seconds
+	Gauges  []gaugeState `json:"gauges"`
+}
+
+type gaugeState struct {
+	Key     string   `json:"key"`
+	Name    string   `json:"name"`
+	Type    string   `json:"type"` // "g" or "fg", as in the statsd line format
+	Value   float64  `json:"value"`
+	Tags    []string `json:"tags,omitempty"`
+	Updated int64    `json:"updated"` // unix seconds
+}
+
+func isGauge(e event.Event) bool {
+	switch e.Type() {
+	case event.EventGauge, event.EventFGauge, event.EventFGaugeDelta:
+		return true
+	}
+	return false
+}
+
+// Writes the current gauge values to sd.stateFile. The file is replaced atomically, so a crash
+// while saving leaves the previous state intact. Must only be called from aggregate(),
+// or before Start().
+func (sd *StatsdCollector) saveGauges() error {
+	state := gaugeStateFile{Version: gaugeStateVersion, Saved: time.Now().Unix(), Gauges: []gaugeState{}}
+	for k, e := range sd.events {
+		updated, ok := sd.gaugeUpdated[k]
+		if !ok || !isGauge(e) {
+			continue
+		}
+		value := e.Payload().(float64)
+		if math.IsNaN(value) || math.IsInf(value, 0) { // json has no encoding for these
+			log.Printf("statsd gauge %s is not saved, as its value is %v", k, value)
+			continue
+		}
+		g := gaugeState{Key: k, Name: e.Key(), Type: "fg", Value: value, Tags: e.GetTags(), Updated: updated.Unix()}
+		if e.Type() == event.EventGauge {
+			g.Type = "g"
+		}
+		state.Gauges = append(state.Gauges, g)
+	}
+	js, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := sd.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sd.stateFile)
+}
+
+// Restores the gauges saved in sd.stateFile into sd.events, leaving out the ones not updated
+// within sd.gaugeMaxAge. A missing state file is not an error. Must be called before Start().
+func (sd *StatsdCollector) restoreGauges() (int, error) {
+	js, err := ioutil.ReadFile(sd.stateFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var state gaugeStateFile
+	if err := json.Unmarshal(js, &state); err != nil {
+		return 0, fmt.Errorf("invalid gauge state file %s: %s", sd.stateFile, err)
+	}
+	if state.Version != gaugeStateVersion {
+		return 0, fmt.Errorf("gauge state file %s has unknown version %d", sd.stateFile, state.Version)
+	}
+	restored := 0
+	now := time.Now()
+	for _, g := range state.Gauges {
+		updated := time.Unix(g.Updated, 0)
+		if sd.gaugeMaxAge > 0 && now.Sub(updated) > sd.gaugeMaxAge {
+			continue
+		}
+		if _, ok := sd.events[g.Key]; ok || len(sd.events) >= sd.eventLimit {
+			continue
+		}
+		switch g.Type {
+		case "g":
+			sd.events[g.Key] = &event.Gauge{Name: g.Name, Value: g.Value, Tags: g.Tags}
+		case "fg":
+			sd.events[g.Key] = &event.FGauge{Name: g.Name, Value: g.Value, Tags: g.Tags}
+		default:
+			continue
+		}
+		sd.gaugeUpdated[g.Key] = updated
+		restored++
+	}
+	return restored, nil
+}
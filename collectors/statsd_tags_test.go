@@ -0,0 +1,41 @@
+package collectors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLineTags(t *testing.T) {
+	e, err := parseLine([]byte("requests:1|c|@0.5|#env:prod,canary,,path:/"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if tags := e.GetTags(); !reflect.DeepEqual(tags, []string{"env:prod", "canary", "path:/"}) {
+		t.Errorf("Line tags: [env:prod canary path:/] != %v", tags)
+	}
+	if e, _ = parseLine([]byte("requests:1|c")); len(e.GetTags()) != 0 {
+		t.Errorf("Tags on an untagged line: %v", e.GetTags())
+	}
+}
+
+func TestTagsKeptOnUpdate(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	for _, line := range []string{"requests:1|c|#env:prod", "requests:2|c|#env:prod", "latency:5|ms|#env:prod", "latency:7|ms|#env:prod", "temp:1|g|#env:prod", "temp:2|g|#env:prod"} {
+		e, err := parseLine([]byte(line))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		sd.processEvent(e)
+	}
+	if len(sd.events) != 3 {
+		t.Fatalf("Events: 3 != %d: %v", len(sd.events), sd.events)
+	}
+	for k, e := range sd.events {
+		for _, m := range e.Metrics() {
+			if !reflect.DeepEqual(m.Tags, []string{"env:prod"}) {
+				t.Errorf("Tags of %s after an update: [env:prod] != %v", k, m.Tags)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package collectors
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// How many events a subscriber may fall behind before events are dropped for it
+const subscriptionBuffer = 1000
+
+// An event as streamed to `scoutd statsd tail`, one json object per line
+type TailRecord struct {
+	Time  time.Time   `json:"time"`
+	Type  string      `json:"type"`
+	Name  string      `json:"name"`
+	Tags  []string    `json:"tags,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+func NewTailRecord(e event.Event) TailRecord {
+	return TailRecord{Time: time.Now(), Type: e.TypeString(), Name: e.Key(), Tags: e.GetTags(), Value: e.Payload()}
+}
+
+// A live feed of the events processed by the aggregator, after rewrite rules and templates
+// have been applied. A subscriber that does not keep up misses events rather than slowing
+// down the aggregator; Dropped() reports how many.
+type Subscription struct {
+	Events   <-chan event.Event
+	events   chan event.Event
+	patterns []*namePattern
+	dropped  int64
+}
+
+// Returns the number of events dropped because the subscriber fell behind
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+func (s *Subscription) wants(name string) bool {
+	if len(s.patterns) == 0 {
+		return true
+	}
+	for _, p := range s.patterns {
+		if p.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+type subscribers struct {
+	mutex sync.Mutex
+	subs  map[*Subscription]bool
+}
+
+// Subscribes to the events matching any of the name patterns, or all events if there are none.
+// The caller must Unsubscribe() when done.
+func (sd *StatsdCollector) Subscribe(patterns []string) (*Subscription, error) {
+	s := &Subscription{events: make(chan event.Event, subscriptionBuffer)}
+	s.Events = s.events
+	for _, p := range patterns {
+		pattern, err := compilePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		s.patterns = append(s.patterns, pattern)
+	}
+	sd.subscribers.mutex.Lock()
+	defer sd.subscribers.mutex.Unlock()
+	if sd.subscribers.subs == nil {
+		sd.subscribers.subs = make(map[*Subscription]bool)
+	}
+	sd.subscribers.subs[s] = true
+	return s, nil
+}
+
+// Ends a subscription and closes its Events channel
+func (sd *StatsdCollector) Unsubscribe(s *Subscription) {
+	sd.subscribers.mutex.Lock()
+	defer sd.subscribers.mutex.Unlock()
+	if sd.subscribers.subs[s] {
+		delete(sd.subscribers.subs, s)
+		close(s.events)
+	}
+}
+
+// Sends a copy of e to the subscribers that want it, without blocking.
+// Called from processEvent(), so the copy is needed as e may be updated later.
+func (sd *StatsdCollector) publish(e event.Event) {
+	sd.subscribers.mutex.Lock()
+	defer sd.subscribers.mutex.Unlock()
+	if len(sd.subscribers.subs) == 0 {
+		return
+	}
+	var e2 event.Event
+	for s := range sd.subscribers.subs {
+		if !s.wants(e.Key()) {
+			continue
+		}
+		if e2 == nil {
+			e2 = e.Copy()
+		}
+		select {
+		case s.events <- e2:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
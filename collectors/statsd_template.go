@@ -0,0 +1,153 @@
+package collectors
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Graphite-style template that splits a dotted metric name into a base name and tags,
+// in the format used by Telegraf:
+//
+//	[filter] template [tag=value,...]
+//
+// Each dot separated part of the template names what the matching part of the metric name is.
+// "measurement" parts are joined to form the base name, "measurement*" takes all remaining parts
+// into the base name, an empty part is skipped, and any other word is used as a tag key.
+// For example, "env.host.service.measurement*" turns prod.web01.nginx.requests.2xx into
+// requests.2xx, tagged env:prod, host:web01 and service:nginx.
+type nameTemplate struct {
+	filter *namePattern
+	parts  []string
+	tags   []string
+}
+
+func parseNameTemplate(s string) (*nameTemplate, error) {
+	fields := strings.Fields(s)
+	t := &nameTemplate{}
+	var filter string
+	switch len(fields) {
+	case 1:
+		t.parts = strings.Split(fields[0], ".")
+	case 2:
+		// either "filter template" or "template tags"
+		if strings.Contains(fields[1], "=") {
+			t.parts = strings.Split(fields[0], ".")
+			t.tags = fields[1:]
+		} else {
+			filter = fields[0]
+			t.parts = strings.Split(fields[1], ".")
+		}
+	case 3:
+		filter = fields[0]
+		t.parts = strings.Split(fields[1], ".")
+		t.tags = fields[2:]
+	default:
+		return nil, fmt.Errorf("invalid template %q: expected [filter] template [tags]", s)
+	}
+	if filter != "" {
+		pattern, err := compilePattern(filter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %s", s, err)
+		}
+		t.filter = pattern
+	}
+
+	hasMeasurement := false
+	for i, part := range t.parts {
+		if part == "measurement" || part == "measurement*" {
+			hasMeasurement = true
+		}
+		if part == "measurement*" && i != len(t.parts)-1 {
+			return nil, fmt.Errorf("invalid template %q: measurement* must be the last part", s)
+		}
+	}
+	if !hasMeasurement {
+		return nil, fmt.Errorf("invalid template %q: no measurement part", s)
+	}
+
+	if t.tags != nil {
+		tags := []string{}
+		for _, kv := range strings.Split(strings.Join(t.tags, ","), ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 || pair[0] == "" || pair[1] == "" {
+				return nil, fmt.Errorf("invalid template %q: bad tag %q", s, kv)
+			}
+			tags = append(tags, pair[0]+":"+pair[1])
+		}
+		t.tags = tags
+	}
+	return t, nil
+}
+
+// Splits name into a base name and tags. Name parts beyond the end of the template are ignored,
+// as in Telegraf. If no part of the name maps to the measurement, the name is left intact.
+func (t *nameTemplate) apply(name string) (string, []string) {
+	nameParts := strings.Split(name, ".")
+	measurement := []string{}
+	tagValues := map[string][]string{}
+	tagOrder := []string{}
+	for i, part := range t.parts {
+		if i >= len(nameParts) {
+			break
+		}
+		switch part {
+		case "":
+		case "measurement":
+			measurement = append(measurement, nameParts[i])
+		case "measurement*":
+			measurement = append(measurement, nameParts[i:]...)
+		default:
+			if _, ok := tagValues[part]; !ok {
+				tagOrder = append(tagOrder, part)
+			}
+			tagValues[part] = append(tagValues[part], nameParts[i])
+		}
+	}
+	if len(measurement) == 0 {
+		return name, nil
+	}
+	tags := make([]string, 0, len(tagOrder)+len(t.tags))
+	for _, key := range tagOrder {
+		tags = append(tags, key+":"+strings.Join(tagValues[key], "."))
+	}
+	tags = append(tags, t.tags...)
+	return strings.Join(measurement, "."), tags
+}
+
+// An ordered list of templates. The first template whose filter matches the name is used;
+// a template without a filter matches every name.
+type nameTemplates []*nameTemplate
+
+func newNameTemplates(templates []string) (nameTemplates, error) {
+	ts := nameTemplates{}
+	for _, s := range templates {
+		t, err := parseNameTemplate(s)
+		if err != nil {
+			return nil, err
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+func (ts nameTemplates) apply(name string) (string, []string) {
+	for _, t := range ts {
+		if t.filter == nil || t.filter.match(name) {
+			return t.apply(name)
+		}
+	}
+	return name, nil
+}
+
+// Returns the key an event is stored under in sd.events: its name, plus its sorted tags if any.
+// Events with the same name but different tags are aggregated separately.
+func eventKey(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	sorted := make([]string, len(tags))
+	copy(sorted, tags)
+	sort.Strings(sorted)
+	return name + "|" + strings.Join(sorted, ",")
+}
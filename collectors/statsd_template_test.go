@@ -0,0 +1,98 @@
+package collectors
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTemplateApply(t *testing.T) {
+	tests := []struct {
+		template string
+		name     string
+		base     string
+		tags     []string
+	}{
+		{"env.host.service.measurement*", "prod.web01.nginx.requests.2xx", "requests.2xx", []string{"env:prod", "host:web01", "service:nginx"}},
+		{"env..measurement", "prod.web01.requests", "requests", []string{"env:prod"}},
+		{"region.region.measurement", "us.west.requests", "requests", []string{"region:us.west"}},
+		{"env.measurement dc=ams,team=ops", "prod.requests", "requests", []string{"env:prod", "dc:ams", "team:ops"}},
+		{"app.* env.service.measurement", "app.api.requests", "requests", []string{"env:app", "service:api"}},
+		{"env.host.measurement", "prod", "prod", nil},
+	}
+	for _, test := range tests {
+		ts, err := newNameTemplates([]string{test.template})
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		base, tags := ts.apply(test.name)
+		if base != test.base {
+			t.Errorf("Template %q on %s base name: %s != %s", test.template, test.name, test.base, base)
+		}
+		if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("Template %q on %s tags: %v != %v", test.template, test.name, test.tags, tags)
+		}
+	}
+}
+
+func TestTemplateFilters(t *testing.T) {
+	ts, err := newNameTemplates([]string{"legacy.* .env.measurement*", "env.measurement*"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	base, tags := ts.apply("legacy.prod.queue.depth")
+	if base != "queue.depth" || !reflect.DeepEqual(tags, []string{"env:prod"}) {
+		t.Errorf("Filtered template: queue.depth [env:prod] != %s %v", base, tags)
+	}
+	base, tags = ts.apply("staging.queue.depth")
+	if base != "queue.depth" || !reflect.DeepEqual(tags, []string{"env:staging"}) {
+		t.Errorf("Default template: queue.depth [env:staging] != %s %v", base, tags)
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	invalid := []string{
+		"env.host",
+		"measurement*.env",
+		"env.measurement dc",
+		"a b c d",
+		"/(/ env.measurement",
+	}
+	for _, template := range invalid {
+		if _, err := parseNameTemplate(template); err == nil {
+			t.Errorf("No error on invalid template %q", template)
+		}
+	}
+}
+
+func TestTemplateAggregation(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetTemplates([]string{"env.host.measurement*"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"prod.web01.requests:1|c", "prod.web01.requests:2|c", "prod.web02.requests:5|c|#path:/"} {
+		e, err := parseLine([]byte(line))
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		sd.processEvent(e)
+	}
+	if len(sd.events) != 2 {
+		t.Fatalf("Events: 2 != %d: %v", len(sd.events), sd.events)
+	}
+	web01, ok := sd.events["requests|env:prod,host:web01"]
+	if !ok {
+		t.Fatalf("Tagged event missing: %v", sd.events)
+	}
+	if 3.0 != web01.Payload() {
+		t.Errorf("Tagged event value: 3 != %v", web01.Payload())
+	}
+	web02, ok := sd.events["requests|env:prod,host:web02,path:/"]
+	if !ok {
+		t.Fatalf("Tagged event with line tags missing: %v", sd.events)
+	}
+	metrics := web02.Metrics()
+	if metrics[0].Name != "requests" || !reflect.DeepEqual(metrics[0].Tags, []string{"env:prod", "host:web02", "path:/"}) {
+		t.Errorf("Tagged metric: requests [env:prod host:web02 path:/] != %s %v", metrics[0].Name, metrics[0].Tags)
+	}
+}
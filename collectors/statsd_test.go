@@ -1,6 +1,20 @@
 package collectors
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
 
 func TestStatsdParseLine(t *testing.T) {
 	var line []byte
@@ -67,4 +81,905 @@ func TestStatsdParseLineCounter(t *testing.T) {
 	if 11.5 != e.Payload() {
 		t.Errorf("SampleRate value incorrect: 11.5 != %f\n", e.Payload())
 	}
-}
\ No newline at end of file
+}
+func TestStatsdSourceAllowlist(t *testing.T) {
+	st, err := newSourceTracker(0, []string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	allowed := &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}
+	single := &net.UDPAddr{IP: net.ParseIP("192.168.1.5"), Port: 5000}
+	denied := &net.UDPAddr{IP: net.ParseIP("192.168.1.6"), Port: 5000}
+	if !st.permitPacket(allowed) {
+		t.Errorf("Packet from %s denied", allowed)
+	}
+	if !st.permitPacket(single) {
+		t.Errorf("Packet from %s denied", single)
+	}
+	if st.permitPacket(denied) {
+		t.Errorf("Packet from %s allowed", denied)
+	}
+	_, deniedCount := st.flush(10)
+	if deniedCount != 1 {
+		t.Errorf("Denied packets: 1 != %d", deniedCount)
+	}
+
+	if _, err := newSourceTracker(0, []string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("No error on invalid CIDR")
+	}
+
+	unix := &net.UnixAddr{Name: "", Net: "unix"}
+	if ip := sourceIP(unix); ip != "unix" {
+		t.Errorf("Source of a Unix socket client: unix != %s", ip)
+	}
+	if st.permitPacket(unix) {
+		t.Errorf("Packet from a Unix socket client allowed without a unix entry")
+	}
+	st, _ = newSourceTracker(0, []string{"10.0.0.0/8", "unix"})
+	if !st.permitPacket(unix) || !st.permitPacket(allowed) || st.permitPacket(denied) {
+		t.Errorf("Allowlist with a unix entry")
+	}
+}
+
+func TestStatsdSourceTopN(t *testing.T) {
+	st, _ := newSourceTracker(0, nil)
+	busy := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	quiet := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5001}
+	st.permitPacket(busy)
+	for i := 0; i < 5; i++ {
+		st.permitLine(busy, "busy.metric", time.Now())
+	}
+	st.permitLine(busy, "other.metric", time.Now())
+	st.permitPacket(quiet)
+	st.permitLine(quiet, "quiet.metric", time.Now())
+
+	top, _ := st.flush(1)
+	if len(top) != 1 {
+		t.Fatalf("Top sources: 1 != %d", len(top))
+	}
+	if top[0].addr != "10.0.0.1" {
+		t.Errorf("Top source: 10.0.0.1 != %s", top[0].addr)
+	}
+	if top[0].lines != 6 || top[0].packets != 1 || len(top[0].names) != 2 {
+		t.Errorf("Top source accounting incorrect: %+v", top[0])
+	}
+
+	top, _ = st.flush(10)
+	for _, s := range top {
+		if s.lines != 0 {
+			t.Errorf("Source %s not reset after flush: %d lines", s.addr, s.lines)
+		}
+	}
+}
+
+func TestStatsdSourceRateLimit(t *testing.T) {
+	st, _ := newSourceTracker(3, nil)
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	permitted := 0
+	for i := 0; i < 10; i++ {
+		if st.permitLine(addr, "limited.metric", time.Now()) {
+			permitted++
+		}
+	}
+	if permitted != 3 {
+		t.Errorf("Permitted lines: 3 != %d", permitted)
+	}
+	top, _ := st.flush(1)
+	if top[0].limited != 7 {
+		t.Errorf("Limited lines: 7 != %d", top[0].limited)
+	}
+
+	// Rate limiting without reporting any sources
+	st.permitLine(addr, "limited.metric", time.Now())
+	if top, _ := st.flush(-1); len(top) != 0 {
+		t.Errorf("Top sources for a negative count: %+v", top)
+	}
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.TrackSources(-1, 3, nil); err == nil {
+		t.Errorf("No error for a negative number of top sources")
+	}
+}
+
+func TestStatsdFilters(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetFilters([]string{"app.*", "/^db\\.(reads|writes)$/"}, []string{"app.noisy.*"}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	permitted := map[string]bool{
+		"app.requests":       true,
+		"app.noisy.lib.call": false,
+		"db.reads":           true,
+		"db.deletes":         false,
+		"other.metric":       false,
+	}
+	for name, expected := range permitted {
+		if sd.filter.permit(name) != expected {
+			t.Errorf("Filter permit %s: %v != %v", name, expected, !expected)
+		}
+	}
+	counts := sd.filter.dropCounts()
+	if counts["deny:app.noisy.*"] != 1 {
+		t.Errorf("Deny rule drop count: 1 != %d", counts["deny:app.noisy.*"])
+	}
+	if counts["not_allowed"] != 2 {
+		t.Errorf("Not allowed drop count: 2 != %d", counts["not_allowed"])
+	}
+	if counts = sd.filter.dropCounts(); len(counts) != 0 {
+		t.Errorf("Drop counts not reset: %v", counts)
+	}
+
+	if err := sd.SetFilters(nil, []string{"/(/"}); err == nil {
+		t.Errorf("No error on invalid regular expression")
+	}
+}
+
+func TestStatsdHostTags(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd.SetHostTags([]string{"host:web01", "environment:production"})
+	e, _ := parseLine([]byte("tagged.counter:1|c|#path:/"))
+	sd.processEvent(e)
+	sd.flush()
+	for _, m := range sd.Payload().Metrics {
+		if m.Name != "tagged.counter" {
+			continue
+		}
+		expected := []string{"path:/", "host:web01", "environment:production"}
+		if !reflect.DeepEqual(m.Tags, expected) {
+			t.Errorf("Metric tags: %v != %v", expected, m.Tags)
+		}
+		// The host tags must not leak into the event itself
+		if tags := sd.eventsSnapshot["tagged.counter|path:/"].GetTags(); len(tags) != 1 {
+			t.Errorf("Event tags modified by payload: %v", tags)
+		}
+		return
+	}
+	t.Errorf("tagged.counter missing from payload")
+}
+
+func TestStatsdCounterOptions(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", 10*time.Second, 100)
+	sd.SetCounterOptions(true, true)
+	// The rate is over the window flushed, which may differ from the flush interval
+	now := time.Now()
+	sd.windowStart = now
+	windows := []time.Duration{10 * time.Second, 5 * time.Second}
+	for i, interval := range [][]string{{"hits:10|c", "hits:20|c"}, {"hits:5|c"}} {
+		for _, line := range interval {
+			e, _ := parseLine([]byte(line))
+			sd.processEvent(e)
+		}
+		now = now.Add(windows[i])
+		sd.flushAt(now)
+	}
+	values := map[string]float64{}
+	types := map[string]string{}
+	for _, m := range sd.Payload().Metrics {
+		values[m.Name] = m.Value
+		types[m.Name] = m.Type
+	}
+	if values["hits"] != 5 || values["hits.rate"] != 1 || values["hits.total"] != 35 {
+		t.Errorf("Counter metrics: hits=5 hits.rate=1 hits.total=35 != %v", values)
+	}
+	if types["hits.rate"] == types["hits.total"] || types["hits.rate"] == types["hits"] {
+		t.Errorf("Counter metric types are not distinct: %v", types)
+	}
+}
+
+func TestStatsdParseLineTypes(t *testing.T) {
+	types := map[string]int{
+		"a:1|c":      event.EventIncr,
+		"a:1|ms":     event.EventTiming,
+		"a:1|g":      event.EventGauge,
+		"a:1|a":      event.EventAbsolute,
+		"a:1.5|fa":   event.EventFAbsolute,
+		"a:1|t":      event.EventTotal,
+		"a:1.5|fg":   event.EventFGauge,
+		"a:+1.5|fg":  event.EventFGaugeDelta,
+		"a:-1.5|fg":  event.EventFGaugeDelta,
+		"a:0.125|pt": event.EventPrecisionTiming,
+	}
+	for line, expected := range types {
+		e, err := parseLine([]byte(line))
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", line, err)
+			continue
+		}
+		if e.Type() != expected {
+			t.Errorf("Type of %s: %d != %d", line, expected, e.Type())
+		}
+	}
+	if _, err := parseLine([]byte("a:1.5|a")); err == nil {
+		t.Errorf("No error on non-integer absolute value")
+	}
+	e, _ := parseLine([]byte("a:0.125|pt"))
+	if d := e.(*event.PrecisionTiming).Value; d != 125*time.Microsecond {
+		t.Errorf("Precision timing value: 125µs != %s", d)
+	}
+}
+
+func TestStatsdAggregateTypes(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	lines := []string{"abs:1|a", "abs:2|a", "tot:5|t", "fg:10|fg", "fg:-2.5|fg", "pt:1|pt", "pt:3|pt"}
+	for _, line := range lines {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	e, _ := parseLine([]byte("tot:1|t"))
+	sd.processEvent(e)
+	sd.flush()
+	values := map[string]float64{}
+	for _, m := range sd.Payload().Metrics {
+		values[m.Name] = m.Value
+	}
+	expected := map[string]float64{"abs": 0, "tot": 6, "fg": 7.5, "pt.count": 0}
+	for name, v := range expected {
+		if values[name] != v {
+			t.Errorf("%s after two flushes: %v != %v", name, v, values[name])
+		}
+	}
+}
+
+func testTypeConflict(t *testing.T, policy string) *StatsdCollector {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetTypeConflictPolicy(policy); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"foo:1|c", "foo:5|ms", "foo:2|c", "foo:7|ms"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	if sd.typeConflicts["foo"] == 0 {
+		t.Errorf("Type conflicts not counted with policy %s", policy)
+	}
+	return sd
+}
+
+func TestStatsdTypeConflictKeepFirst(t *testing.T) {
+	sd := testTypeConflict(t, ConflictKeepFirst)
+	if len(sd.events) != 1 || sd.events["foo"].Type() != event.EventIncr || sd.events["foo"].Payload() != 3.0 {
+		t.Errorf("Events after conflicts with keep_first: %v", sd.events)
+	}
+	sd.flush()
+	conflicts, ok := sd.eventsSnapshot["statsd.type_conflicts|foo"]
+	if !ok || conflicts.Payload() != 2.0 {
+		t.Errorf("Type conflicts reported: 2 != %v", conflicts)
+	}
+	if len(sd.typeConflicts) != 0 {
+		t.Errorf("Type conflicts not reset on flush")
+	}
+}
+
+func TestStatsdTypeConflictReplace(t *testing.T) {
+	sd := testTypeConflict(t, ConflictReplace)
+	if len(sd.events) != 1 || sd.events["foo"].Type() != event.EventTiming {
+		t.Errorf("Events after conflicts with replace: %v", sd.events)
+	}
+}
+
+func TestStatsdTypeConflictByType(t *testing.T) {
+	sd := testTypeConflict(t, ConflictByType)
+	if len(sd.events) != 2 {
+		t.Fatalf("Events after conflicts with by_type: 2 != %d", len(sd.events))
+	}
+	timing, ok := sd.events["foo#Timing"]
+	if !ok || timing.(*event.Timing).Count != 2 {
+		t.Errorf("Timing aggregated separately: %v", sd.events)
+	}
+}
+
+func TestStatsdTypeConflictPolicyInvalid(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetTypeConflictPolicy("newest"); err == nil {
+		t.Errorf("No error on unknown type conflict policy")
+	}
+}
+
+func TestStatsdPayloadWindow(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	start := time.Now().Unix()
+	for _, line := range []string{"hits:1|c", "hits:1|c", "hits:1|c", "latency:5|ms"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	end := time.Now().Unix()
+	samples := map[string]int64{}
+	for _, m := range sd.Payload().Metrics {
+		samples[m.Name] = m.Samples
+		if m.WindowStart < start || m.WindowEnd > end || m.WindowStart > m.WindowEnd {
+			t.Errorf("%s window %d-%d outside of %d-%d", m.Name, m.WindowStart, m.WindowEnd, start, end)
+		}
+		if m.Interval < 0 || m.Interval > float64(end-start+1) {
+			t.Errorf("%s interval: %v", m.Name, m.Interval)
+		}
+	}
+	if samples["hits"] != 3 || samples["latency.max"] != 1 {
+		t.Errorf("Samples: hits=3 latency.max=1 != %v", samples)
+	}
+
+	sd.flush()
+	for _, m := range sd.Payload().Metrics {
+		if m.Samples != 0 {
+			t.Errorf("%s samples not reset on flush: %d", m.Name, m.Samples)
+		}
+	}
+}
+
+func TestStatsdHistograms(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	err := sd.SetHistograms([]HistogramConfig{
+		{Match: "api.*", Buckets: "100, 10, 50"},
+		{Match: "/^db\\./", Exponential: "1,2,4"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if b := findHistogramBuckets(sd.histograms, "api.latency"); !reflect.DeepEqual(b, []float64{10, 50, 100}) {
+		t.Errorf("Fixed buckets: [10 50 100] != %v", b)
+	}
+	if b := findHistogramBuckets(sd.histograms, "db.query"); !reflect.DeepEqual(b, []float64{1, 2, 4, 8}) {
+		t.Errorf("Exponential buckets: [1 2 4 8] != %v", b)
+	}
+
+	for _, line := range []string{"api.latency:20|ms", "api.latency:70|ms", "other.latency:5|ms"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	buckets := map[string]float64{}
+	for _, m := range sd.Payload().Metrics {
+		if m.Type == "histogram" {
+			buckets[m.Name+" "+m.Tags[len(m.Tags)-1]] = m.Value
+		}
+	}
+	expected := map[string]float64{
+		"api.latency.bucket le:10":   0,
+		"api.latency.bucket le:50":   1,
+		"api.latency.bucket le:100":  2,
+		"api.latency.bucket le:+Inf": 2,
+	}
+	if !reflect.DeepEqual(buckets, expected) {
+		t.Errorf("Histogram buckets: %v != %v", expected, buckets)
+	}
+
+	invalid := []HistogramConfig{
+		{Match: "a", Buckets: "1,x"},
+		{Match: "a", Exponential: "1,2"},
+		{Match: "a", Exponential: "0,2,4"},
+		{Match: "a"},
+		{Match: "a", Buckets: "1", Exponential: "1,2,3"},
+		{Buckets: "1"},
+	}
+	for _, c := range invalid {
+		if err := sd.SetHistograms([]HistogramConfig{c}); err == nil {
+			t.Errorf("No error on invalid histogram config %+v", c)
+		}
+	}
+}
+
+func TestStatsdMetricOverrides(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", 10*time.Second, 100)
+	err := sd.SetMetricOverrides([]MetricOverride{
+		{Match: "api.latency", Percentiles: "99, 99.9"},
+		{Match: "batch.*", Stats: "mean,max", Percentiles: "none"},
+		{Match: "jobs.*", CounterRates: "true", Cumulative: "true"},
+	})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	for _, line := range []string{"api.latency:10|ms", "batch.run:20|ms", "jobs.done:5|c", "other.done:1|c"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	names := map[string]bool{}
+	for _, m := range sd.Payload().Metrics {
+		names[m.Name] = true
+	}
+	for _, name := range []string{"api.latency.count", "api.latency.upper_99", "api.latency.upper_99_9", "batch.run.mean", "batch.run.max", "jobs.done.rate", "jobs.done.total"} {
+		if !names[name] {
+			t.Errorf("Metric %s missing from payload", name)
+		}
+	}
+	for _, name := range []string{"api.latency.upper_95", "batch.run.count", "batch.run.upper_95", "other.done.rate", "other.done.total"} {
+		if names[name] {
+			t.Errorf("Metric %s in payload", name)
+		}
+	}
+
+	invalid := []MetricOverride{
+		{Match: "a", Stats: "mean,median"},
+		{Match: "a", Percentiles: "0"},
+		{Match: "a", Percentiles: "101"},
+		{Match: "a", CounterRates: "yes"},
+		{Match: "/(/", Stats: "mean"},
+	}
+	for _, c := range invalid {
+		if err := sd.SetMetricOverrides([]MetricOverride{c}); err == nil {
+			t.Errorf("No error on invalid override %+v", c)
+		}
+	}
+}
+
+func TestStatsdGaugePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gauges.json")
+
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd.SetGaugePersistence(path, time.Hour)
+	for _, line := range []string{"queue.depth:5|g", "pool.size:2.5|fg|#db:main", "stale:1|g", "requests:1|c", "ratio:NaN|g", "limit:Inf|fg"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.gaugeUpdated["stale"] = time.Now().Add(-2 * time.Hour)
+	if len(sd.events) != 6 {
+		t.Fatalf("Events before saving: 6 != %d: %v", len(sd.events), sd.events)
+	}
+	sd.running = true
+	go sd.aggregate()
+	if err := sd.Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %s", err)
+	}
+
+	sd2, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd2.SetGaugePersistence(path, time.Hour)
+	n, err := sd2.restoreGauges()
+	if err != nil {
+		t.Fatalf("Restore: %s", err)
+	}
+	if n != 2 || len(sd2.events) != 2 {
+		t.Fatalf("Restored gauges: 2 != %d: %v", n, sd2.events)
+	}
+	if e, ok := sd2.events["queue.depth"].(*event.Gauge); !ok || e.Value != 5 {
+		t.Errorf("Restored gauge queue.depth: %v", sd2.events["queue.depth"])
+	}
+	e, ok := sd2.events["pool.size|db:main"].(*event.FGauge)
+	if !ok || e.Value != 2.5 || !reflect.DeepEqual(e.Tags, []string{"db:main"}) {
+		t.Errorf("Restored gauge pool.size: %v", sd2.events["pool.size|db:main"])
+	}
+	delta, _ := parseLine([]byte("pool.size:+1|fg|#db:main"))
+	sd2.processEvent(delta)
+	if v := sd2.events["pool.size|db:main"].Payload(); v != 3.5 {
+		t.Errorf("Restored gauge after delta: 3.5 != %v", v)
+	}
+
+	sd3, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd3.SetGaugePersistence(filepath.Join(dir, "missing.json"), time.Hour)
+	if n, err := sd3.restoreGauges(); n != 0 || err != nil {
+		t.Errorf("Restore from a missing state file: %d %v", n, err)
+	}
+}
+
+func TestStatsdHandoff(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer client.Close()
+
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd.StartWith(conn, nil)
+	client.Write([]byte("requests:2|c\nlatency:10|ms\nqueue:7|g"))
+	time.Sleep(100 * time.Millisecond)
+	f, state, err := sd.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff: %s", err)
+	}
+	defer f.Close()
+
+	conn2, err := net.FilePacketConn(f)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sd2, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd2.StartWith(conn2, state); err != nil {
+		t.Fatalf("StartWith: %s", err)
+	}
+	client.Write([]byte("requests:3|c\nlatency:30|ms"))
+	time.Sleep(100 * time.Millisecond)
+	sd2.stop()
+	conn2.Close()
+
+	if len(sd2.events) != 3 {
+		t.Fatalf("Events after handoff: 3 != %d: %v", len(sd2.events), sd2.events)
+	}
+	if v := sd2.events["requests"].Payload(); v != 5.0 {
+		t.Errorf("Counter after handoff: 5 != %v", v)
+	}
+	if timing, ok := sd2.events["latency"].(*event.Timing); !ok || timing.Count != 2 || timing.Max != 30 {
+		t.Errorf("Timing after handoff: %v", sd2.events["latency"])
+	}
+	if v := sd2.events["queue"].Payload(); v != 7.0 {
+		t.Errorf("Gauge after handoff: 7 != %v", v)
+	}
+	if !sd2.windowStart.Equal(sd.windowStart) {
+		t.Errorf("Flush window start: %v != %v", sd.windowStart, sd2.windowStart)
+	}
+}
+
+func TestStatsdHandoffStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd.StartListener(l)
+	send := func(lines string) {
+		client, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		client.Write([]byte(lines))
+		client.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	send("requests:2|c\n")
+	f, state, err := sd.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff: %s", err)
+	}
+	defer f.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Socket file removed by the handoff: %s", err)
+	}
+
+	sd2, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd2.TakeOver(f, state); err != nil {
+		t.Fatalf("TakeOver: %s", err)
+	}
+	send("requests:3|c\n")
+	sd2.stop()
+	if v := sd2.events["requests"].Payload(); v != 5.0 {
+		t.Errorf("Counter after handoff of a stream listener: 5 != %v", v)
+	}
+}
+
+func TestStatsdHandoffSnapshot(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	for _, line := range []string{"requests:2|c", "queue:NaN|g"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	sd.flush()
+	state, err := sd.marshalState()
+	if err != nil {
+		t.Fatalf("marshalState: %s", err)
+	}
+
+	sd2, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd2.unmarshalState(state); err != nil {
+		t.Fatalf("unmarshalState: %s", err)
+	}
+	metrics := map[string]float64{}
+	if p := sd2.RestoredPayload(); p != nil {
+		for _, m := range p.Metrics {
+			metrics[m.Name] = m.Value
+		}
+	}
+	if metrics["requests"] != 2.0 {
+		t.Errorf("Restored snapshot: requests 2 != %v", metrics)
+	}
+	if _, ok := metrics["queue"]; ok {
+		t.Errorf("Restored snapshot with a NaN gauge: %v", metrics)
+	}
+
+	// A second hot restart before the next flush keeps the snapshot
+	state, _ = sd2.marshalState()
+	sd3, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	sd3.unmarshalState(state)
+	if p := sd3.RestoredPayload(); p == nil || len(p.Metrics) != len(sd2.RestoredPayload().Metrics) {
+		t.Errorf("Snapshot after a second handoff: %v", p)
+	}
+}
+
+func TestStatsdCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture.jsonl")
+
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.StartCapture(time.Minute); err == nil {
+		t.Errorf("No error starting a capture without a capture file")
+	}
+	sd.SetCaptureFile(path)
+	if err := sd.StartCapture(2 * MaxCaptureDuration); err == nil {
+		t.Errorf("No error starting a capture longer than %s", MaxCaptureDuration)
+	}
+	if err := sd.StartCapture(time.Minute); err != nil {
+		t.Fatalf("StartCapture: %s", err)
+	}
+	if err := sd.StartCapture(time.Minute); err == nil {
+		t.Errorf("No error starting a second capture")
+	}
+	source := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}
+	sd.capture.record(source, []byte("requests:2|c\nlatency:10|ms"))
+	sd.capture.record(source, []byte("requests:3|c\nbad line"))
+	if n, err := sd.capture.stop(); n != 2 || err != nil {
+		t.Fatalf("Capture stopped with %d packets: %v", n, err)
+	}
+	sd.capture.record(source, []byte("requests:100|c"))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer f.Close()
+	replay, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := replay.TrackSources(5, 0, nil); err != nil {
+		t.Fatalf("%s", err)
+	}
+	payload, err := replay.Replay(f)
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	values := map[string]float64{}
+	for _, m := range payload.Metrics {
+		values[m.Name] = m.Value
+	}
+	if values["requests"] != 5 || values["latency.count"] != 1 {
+		t.Errorf("Replayed metrics: requests 5, latency.count 1 != %v", values)
+	}
+	if values["statsd.source.packets"] != 2 {
+		t.Errorf("Replayed packets from the captured source: 2 != %v", values["statsd.source.packets"])
+	}
+}
+
+func TestStatsdReplayRateLimit(t *testing.T) {
+	// 4 lines a second for 5 seconds, captured hours ago, from a source limited to 5 a second
+	var capture bytes.Buffer
+	encoder := json.NewEncoder(&capture)
+	start := time.Now().Add(-3 * time.Hour)
+	for i := 0; i < 20; i++ {
+		encoder.Encode(captureRecord{Time: start.Add(time.Duration(i) * 250 * time.Millisecond), Source: "10.0.0.1:5000", Data: "requests:1|c"})
+	}
+	replay, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := replay.TrackSources(5, 5, nil); err != nil {
+		t.Fatalf("%s", err)
+	}
+	payload, err := replay.Replay(&capture)
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+	for _, m := range payload.Metrics {
+		if m.Name == "requests" && m.Value != 20 {
+			t.Errorf("Replayed lines under the rate limit: 20 != %v", m.Value)
+		}
+	}
+}
+
+func TestStatsdSubscribe(t *testing.T) {
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetRewriteRules([]RewriteRule{{Type: RewritePrefix, Match: "*", Value: "app."}}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	all, _ := sd.Subscribe(nil)
+	api, err := sd.Subscribe([]string{"app.api.*"})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := sd.Subscribe([]string{"/(/"}); err == nil {
+		t.Errorf("No error subscribing with an invalid pattern")
+	}
+	for _, line := range []string{"api.requests:1|c", "db.queries:2|c", "api.requests:3|c"} {
+		e, _ := parseLine([]byte(line))
+		sd.processEvent(e)
+	}
+	if len(all.Events) != 3 || len(api.Events) != 2 {
+		t.Fatalf("Subscribed events: 3, 2 != %d, %d", len(all.Events), len(api.Events))
+	}
+	first, second := <-api.Events, <-api.Events
+	if first.Key() != "app.api.requests" || first.Payload() != 1.0 || second.Payload() != 3.0 {
+		t.Errorf("Subscribed events are not the events as received: %v %v", first, second)
+	}
+	sd.Unsubscribe(api)
+	if _, open := <-api.Events; open {
+		t.Errorf("Events channel open after Unsubscribe")
+	}
+
+	for i := 0; i < subscriptionBuffer+5; i++ {
+		e, _ := parseLine([]byte("db.queries:1|c"))
+		sd.processEvent(e)
+	}
+	if all.Dropped() != 8 {
+		t.Errorf("Dropped events: 8 != %d", all.Dropped())
+	}
+	sd.Unsubscribe(all)
+	sd.Unsubscribe(all)
+}
+
+func TestStatsdParseLineExported(t *testing.T) {
+	// Lines are parsed exactly as the collector parses them, so surrounding whitespace is invalid
+	tests := []struct {
+		line string
+		key  string
+		tags []string
+	}{
+		{line: "requests:3|c", key: "requests"},
+		{line: "requests:3|c|#path:/", key: "requests", tags: []string{"path:/"}},
+		{line: "requests:3|c|@0.5", key: "requests"},
+		{line: "latency:12.5|ms", key: "latency"},
+		{line: "requests:3|c\r"},
+		{line: "requests:3|c "},
+		{line: " requests:3|c", key: " requests"}, // the space is part of the name
+		{line: "requests:3|c\n"},
+		{line: ""},
+		{line: "requests"},
+		{line: "requests:x|c"},
+		{line: "requests:1|zz"},
+	}
+	for _, test := range tests {
+		e, err := ParseLine(test.line)
+		if test.key == "" {
+			if err == nil {
+				t.Errorf("No error parsing %q", test.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", test.line, err)
+			continue
+		}
+		if e.Key() != test.key || strings.Join(e.GetTags(), ",") != strings.Join(test.tags, ",") {
+			t.Errorf("Parsed %q: %s %v != %s %v", test.line, test.key, test.tags, e.Key(), e.GetTags())
+		}
+	}
+}
+
+func TestRelayHashRing(t *testing.T) {
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "metric." + strconv.Itoa(i)
+	}
+	ring := newHashRing([]string{"a:8125", "b:8125", "c:8125"})
+	counts := make([]int, 3)
+	owners := make(map[string]int)
+	for _, name := range names {
+		owners[name] = ring.get(name)
+		counts[owners[name]]++
+	}
+	for i, n := range counts {
+		if n < 200 {
+			t.Errorf("Upstream %d owns only %d of 1000 names: %v", i, n, counts)
+		}
+	}
+	// Removing upstream b only moves the names it owned
+	smaller := newHashRing([]string{"a:8125", "c:8125"})
+	for _, name := range names {
+		before := []string{"a:8125", "b:8125", "c:8125"}[owners[name]]
+		after := []string{"a:8125", "c:8125"}[smaller.get(name)]
+		if before != "b:8125" && before != after {
+			t.Errorf("%s moved from %s to %s", name, before, after)
+		}
+	}
+}
+
+func TestStatsdRelay(t *testing.T) {
+	upstreams := []net.PacketConn{}
+	addrs := []string{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		defer conn.Close()
+		upstreams = append(upstreams, conn)
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetRelay(addrs, []string{"app.*"}, 0); err != nil {
+		t.Fatalf("%s", err)
+	}
+	sent := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		line := "app.metric" + strconv.Itoa(i) + ":1|c"
+		sent[line] = true
+		for _, e := range sd.parseMessage(nil, []byte(line+"\nother.metric:1|c\nbad"), time.Now()) {
+			sd.processEvent(e)
+		}
+	}
+	sd.relay.stop()
+
+	received := map[string]int{}
+	buf := make([]byte, 65535)
+	for i, conn := range upstreams {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if !sent[line] {
+					t.Errorf("Unexpected line relayed: %q", line)
+				}
+				e, _ := parseLine([]byte(line))
+				if owner := sd.relay.ring.get(e.Key()); owner != i {
+					t.Errorf("%s relayed to upstream %d instead of %d", line, i, owner)
+				}
+				received[line]++
+			}
+		}
+	}
+	if len(received) != len(sent) {
+		t.Errorf("Relayed lines: %d != %d", len(sent), len(received))
+	}
+
+	sd.Flush()
+	var relayed float64
+	for _, m := range sd.Payload().Metrics {
+		if m.Name == "statsd.relay.sent" {
+			relayed += m.Value
+		}
+	}
+	if relayed != 20 {
+		t.Errorf("statsd.relay.sent: 20 != %v", relayed)
+	}
+}
+
+func TestStatsdRelayUpstreamDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.RemoveAll(dir)
+	sd, _ := NewStatsdCollector("statsd", "", time.Minute, 100)
+	if err := sd.SetRelay([]string{"unix://" + filepath.Join(dir, "missing.sock")}, nil, 0); err != nil {
+		t.Fatalf("SetRelay with an upstream that is down: %s", err)
+	}
+	defer sd.relay.stop()
+	if errors := sd.relay.upstreams[0].errors; errors != 1 {
+		t.Errorf("Errors for an upstream that is down: 1 != %d", errors)
+	}
+	if err := sd.SetRelay([]string{"ftp://127.0.0.1:8125"}, nil, 0); err == nil {
+		t.Errorf("No error for an invalid upstream")
+	}
+}
+
+func TestStatsdRelayDrops(t *testing.T) {
+	r := &relay{ring: newHashRing([]string{"slow"})}
+	u := &relayUpstream{addr: "slow", lines: make(chan string, 2)}
+	r.upstreams = []*relayUpstream{u}
+	for i := 0; i < 5; i++ {
+		r.forward("metric", []byte("metric:1|c"))
+	}
+	if u.dropped != 3 {
+		t.Errorf("Dropped lines: 3 != %d", u.dropped)
+	}
+}
+
+func TestStatsdRelayStopTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { relayStopTimeout = timeout }(relayStopTimeout)
+	relayStopTimeout = 100 * time.Millisecond
+	r := &relay{ring: newHashRing([]string{"stuck"})}
+	u := &relayUpstream{addr: "stuck", lines: make(chan string, 2), done: make(chan bool)} // never done
+	r.upstreams = []*relayUpstream{u}
+	r.forward("metric", []byte("metric:1|c"))
+	stopped := make(chan bool)
+	go func() {
+		r.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Stopping the relay waited for a stuck upstream")
+	}
+}
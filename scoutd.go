@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,10 +22,15 @@ import (
 
 	"github.com/pingdomserver/scoutd/collectors"
 	"github.com/pingdomserver/scoutd/scoutd"
+	"github.com/pingdomserver/scoutd/sinks"
 )
 
 var config scoutd.ScoutConfig
 var activeCollectors map[string]collectors.Collector
+var payloadListener net.Listener
+var payloadSink *sinks.HTTPSink
+var metricsSink *sinks.PrometheusSink
+var sinkManager *sinks.Manager
 
 func main() {
 	os.Setenv("SCOUTD_VERSION", scoutd.Version) // Used by child processes to determine if they are being run under scoutd
@@ -41,7 +48,7 @@ func main() {
 
 	// Listen for signals
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
 	go signalHandler(sigChan)
 
 	// What command was invoked
@@ -63,6 +70,15 @@ func main() {
 		config.Log.Println("Running debug")
 		runDebug()
 	}
+	if config.SubCommand == "statsd replay" {
+		scoutd.RunStatsdReplay(config)
+	}
+	if config.SubCommand == "statsd send" {
+		scoutd.RunStatsdSend(config)
+	}
+	if config.SubCommand == "statsd tail" {
+		scoutd.RunStatsdTail(config)
+	}
 	if config.SubCommand == "test" {
 		config.Log.Println("Testing plugin")
 		scoutd.RunTest(config)
@@ -70,9 +86,21 @@ func main() {
 }
 
 func startDaemon() {
-	// Sleep before startup.
-	// Just precautionary so that we don't consume 100% CPU in case of respawn loops
-	time.Sleep(1 * time.Second)
+	// If we were started by a running scoutd for a hot restart, take over its sockets and state.
+	var handoff *scoutd.Handoff
+	if path := os.Getenv(scoutd.HandoffSocketEnv); path != "" {
+		os.Unsetenv(scoutd.HandoffSocketEnv)
+		var err error
+		if handoff, err = scoutd.ReceiveHandoff(path); err != nil {
+			config.Log.Printf("Error receiving hot restart handoff: %s", err)
+		} else {
+			config.Log.Println("Took over sockets and state from the previous scoutd")
+		}
+	} else {
+		// Sleep before startup.
+		// Just precautionary so that we don't consume 100% CPU in case of respawn loops
+		time.Sleep(1 * time.Second)
+	}
 
 	// All necessary configuration checks and setup tasks should pass
 	// Just log the error for now
@@ -86,8 +114,9 @@ func startDaemon() {
 	var agentRunning = &sync.Mutex{}
 	config.Log.Println("Created agent")
 
-	go initCollectors()
-	go initPayloadEndpoint()
+	initSinks()
+	go initCollectors(handoff)
+	go initPayloadEndpoint(handoff)
 	if config.DisableRealtime != "true" {
 		config.Log.Println("Realtime enabled")
 		go initPusher(agentRunning, &wg)
@@ -99,46 +128,157 @@ func startDaemon() {
 	wg.Wait()
 }
 
+// Creates the sinks that flushed collector payloads are delivered to: the payload endpoint,
+// the Prometheus metrics endpoint, plus any configured in the sinks section of the config.
+func initSinks() {
+	sinkManager = sinks.NewManager()
+	payloadSink = sinks.NewHTTPSink()
+	sinkManager.Add(payloadSink, 1, sinks.RetryPolicy{})
+	metricsSink = sinks.NewPrometheusSink()
+	if ttl, err := time.ParseDuration(config.MetricsSeriesTTL); err != nil {
+		config.Log.Printf("error configuring the metrics series TTL: %s", err)
+	} else {
+		metricsSink.SetSeriesTTL(ttl)
+	}
+	sinkManager.Add(metricsSink, sinks.DefaultQueueSize, sinks.RetryPolicy{}) // a dropped flush would be missing from the counters
+	for _, configured := range config.Sinks {
+		// Sinks get the host's details and the RunDir as options too, eg: for a graphite prefix
+		options := map[string]string{"hostname": config.HostName, "environment": config.AgentEnv, "roles": config.AgentRoles, "run_dir": config.RunDir}
+		for k, v := range configured {
+			options[k] = v
+		}
+		queueSize, retry, err := sinks.QueueOptions(options)
+		if err != nil {
+			config.Log.Printf("error configuring %s sink: %s", options["type"], err)
+			continue
+		}
+		sink, err := sinks.New(options)
+		if err != nil {
+			config.Log.Printf("error creating sink: %s", err)
+			continue
+		}
+		sinkManager.Add(sink, queueSize, retry)
+		config.Log.Printf("Added %s sink", sink.Name())
+	}
+}
+
 // Initialize and start Collectors
 // Hardcoded to start a single statsdCollector for now.
-func initCollectors() {
+// If handoff is not nil, the statsd collector uses the socket and state it holds.
+func initCollectors(handoff *scoutd.Handoff) {
 	activeCollectors = make(map[string]collectors.Collector)
 
 	if config.Statsd.Enabled == "true" {
 		flushInterval := time.Duration(60) * time.Second
 		if statsd, err := collectors.NewStatsdCollector("statsd", config.Statsd.Addr, flushInterval, config.Statsd.EventLimit); err != nil {
 			config.Log.Printf("error creating statsd collector: %s", err)
+		} else if err := scoutd.ConfigureStatsd(config, statsd); err != nil {
+			config.Log.Printf("%s, not starting the statsd collector", err)
+			if handoff != nil && handoff.StatsdSocket != nil {
+				handoff.StatsdSocket.Close()
+			}
 		} else {
-			statsd.Start()
+			if config.Statsd.PersistGauges == "true" && config.RunDir != "" {
+				if maxAge, err := time.ParseDuration(config.Statsd.GaugeMaxAge); err != nil {
+					config.Log.Printf("error configuring statsd gauge persistence: %s", err)
+				} else {
+					statsd.SetGaugePersistence(filepath.Join(config.RunDir, scoutd.GaugeStateFile), maxAge)
+				}
+			}
+			statsd.SetCaptureFile(config.Statsd.CaptureFile)
+			statsd.SetFlushHook(func(p *collectors.CollectorPayload) {
+				sinkManager.Publish([]*collectors.CollectorPayload{p})
+			})
+			if err := statsd.SetRelay(config.Statsd.RelayUpstreams, config.Statsd.RelayMatch, config.Statsd.RelayBuffer); err != nil {
+				config.Log.Printf("error configuring statsd relay: %s", err)
+			}
+			if handoff != nil && handoff.StatsdSocket != nil {
+				err := statsd.TakeOver(handoff.StatsdSocket, handoff.StatsdState)
+				if err != nil && handoff.StatsdState != nil {
+					config.Log.Printf("%s", err)
+					err = statsd.TakeOver(handoff.StatsdSocket, nil) // the socket without the state
+				}
+				handoff.StatsdSocket.Close()
+				if err != nil {
+					config.Log.Printf("error taking over statsd socket: %s", err)
+					statsd.Start()
+				} else if p := statsd.RestoredPayload(); p != nil {
+					// Only the payload endpoint lost it: the other sinks already have it
+					payloadSink.Write([]*collectors.CollectorPayload{p})
+				}
+			} else {
+				statsd.Start()
+			}
 			activeCollectors[statsd.Name()] = statsd
+			if config.Statsd.CaptureDuration != "" {
+				if duration, err := time.ParseDuration(config.Statsd.CaptureDuration); err != nil {
+					config.Log.Printf("error configuring statsd capture: %s", err)
+				} else if err := statsd.StartCapture(duration); err != nil {
+					config.Log.Printf("error starting statsd capture: %s", err)
+				}
+			}
 		}
 	}
 }
 
 // The Ruby scout-client will be fetching json data from the Scout Collectors and
 // including that in the checkin bundle.
-func initPayloadEndpoint() {
-	http.HandleFunc("/", writePayload)
-	http.ListenAndServe(scoutd.DefaultPayloadAddr, nil)
+// If handoff is not nil, its listener is used rather than binding a new one.
+func initPayloadEndpoint(handoff *scoutd.Handoff) {
+	http.Handle("/", payloadSink)
+	http.Handle(scoutd.MetricsPath, metricsSink)
+	http.HandleFunc(scoutd.StatsdTailPath, streamStatsdEvents)
+	var l net.Listener
+	var err error
+	if handoff != nil && handoff.PayloadListener != nil {
+		l, err = net.FileListener(handoff.PayloadListener)
+		handoff.PayloadListener.Close()
+	}
+	if l == nil {
+		if l, err = net.Listen("tcp", scoutd.DefaultPayloadAddr); err != nil {
+			config.Log.Printf("Error starting payload endpoint: %s", err)
+			return
+		}
+	}
+	payloadListener = l
+	http.Serve(l, nil)
 }
 
-// Compiles the Collector.Payload() data and encodes to json and writes to w.
-func writePayload(w http.ResponseWriter, r *http.Request) {
-	payloads := make([]*collectors.CollectorPayload, len(activeCollectors))
-	i := 0
-	for _, c := range activeCollectors {
-		payloads[i] = c.Payload()
-		i++
-	}
-	p := make(map[string][]*collectors.CollectorPayload, 1)
-	p["collectors"] = payloads
-	js, err := json.Marshal(p)
+// Streams the events processed by the statsd collector to w as json lines, until the client
+// disconnects. Only events whose names match one of the "match" query parameters are sent,
+// if any are given.
+func streamStatsdEvents(w http.ResponseWriter, r *http.Request) {
+	sd, ok := activeCollectors["statsd"].(*collectors.StatsdCollector)
+	if !ok {
+		http.Error(w, "statsd is not enabled", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	sub, err := sd.Subscribe(r.URL.Query()["match"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
+	defer sd.Unsubscribe(sub)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-sub.Events:
+			if err := encoder.Encode(collectors.NewTailRecord(e)); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
 func initPusher(agentRunning *sync.Mutex, wg *sync.WaitGroup) {
@@ -375,6 +515,109 @@ func signalHandler(sigChan <-chan os.Signal) {
 		case syscall.SIGUSR1:
 			config.Log.Printf("Received SIGUSR1. Running debug/troublehsoot routine.\n")
 			runDebug()
+		case syscall.SIGUSR2:
+			config.Log.Printf("Received SIGUSR2. Starting hot restart.\n")
+			if err := hotRestart(); err != nil {
+				config.Log.Printf("Hot restart failed, continuing: %s", err)
+			} else {
+				os.Exit(0)
+			}
+		case syscall.SIGTERM, syscall.SIGINT:
+			config.Log.Printf("Received %s. Shutting down.\n", sig)
+			shutdownCollectors()
+			os.Exit(0)
+		}
+	}
+}
+
+// Stops the active collectors, so they can save their state before scoutd exits
+func shutdownCollectors() {
+	for name, c := range activeCollectors {
+		if err := c.Shutdown(); err != nil {
+			config.Log.Printf("Error shutting down collector %s: %s", name, err)
+		}
+	}
+	if sinkManager != nil {
+		sinkManager.Close(5 * time.Second) // delivers the payloads still queued
+	}
+}
+
+// Starts a new scoutd with the same arguments, and passes it the statsd and payload sockets and
+// the statsd aggregation state over a Unix socket, so no packets or metrics are lost.
+// Returns nil once the new process has taken over, at which point this one should exit, after
+// reporting the new process to systemd as the main process of the service (see NotifyMainPID).
+// On error, this process keeps running, with its statsd collector resumed.
+func hotRestart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir := config.RunDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	sockPath := filepath.Join(dir, fmt.Sprintf("scoutd-handoff-%d.sock", os.Getpid()))
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer l.Close() // removes sockPath
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), scoutd.HandoffSocketEnv+"="+sockPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	abort := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	l.SetDeadline(time.Now().Add(30 * time.Second))
+	conn, err := l.AcceptUnix()
+	if err != nil {
+		abort()
+		return err
+	}
+	defer conn.Close()
+
+	handoff := &scoutd.Handoff{}
+	var statsd *collectors.StatsdCollector
+	if c, ok := activeCollectors["statsd"].(*collectors.StatsdCollector); ok {
+		// The new process can't bind the statsd address while this process has it
+		if handoff.StatsdSocket, handoff.StatsdState, err = c.Handoff(); err != nil {
+			abort()
+			return fmt.Errorf("error handing off statsd: %s", err)
+		}
+		statsd = c
+		defer handoff.StatsdSocket.Close()
+	}
+	if tl, ok := payloadListener.(*net.TCPListener); ok {
+		if handoff.PayloadListener, err = tl.File(); err == nil {
+			defer handoff.PayloadListener.Close()
+		}
+	}
+	if err := scoutd.SendHandoff(conn, handoff); err != nil {
+		abort()
+		if statsd != nil {
+			statsd.TakeOver(handoff.StatsdSocket, nil) // its events were kept
 		}
+		return err
+	}
+
+	if payloadListener != nil {
+		payloadListener.Close() // the new process serves the payload endpoint from now on
 	}
+	// Deliver what is queued for the relay and sinks. Gauges are not saved, the new process has them.
+	if statsd != nil {
+		statsd.FinishHandoff()
+	}
+	if sinkManager != nil {
+		sinkManager.Close(5 * time.Second)
+	}
+	if err := scoutd.NotifyMainPID(cmd.Process.Pid); err != nil {
+		config.Log.Printf("Error reporting the new scoutd process to systemd: %s", err)
+	}
+	return nil
 }
@@ -27,6 +27,7 @@ const yamlTemplate = `
 {{ if ne .current.HttpProxyUrl .default.HttpProxyUrl }}http_proxy: {{ .current.HttpProxyUrl }}{{ end }}
 {{ if ne .current.HttpsProxyUrl .default.HttpsProxyUrl }}https_proxy: {{ .current.HttpsProxyUrl }}{{ end }}
 {{ if .current.IgnoredDevices }}ignored_devices: {{ .current.IgnoredDevices }}{{ end }}
+{{ if ne .current.MetricsSeriesTTL .default.MetricsSeriesTTL }}metrics_series_ttl: {{ .current.MetricsSeriesTTL }}{{ end }}
 {{ if .current.DisableRealtime }}disable_realtime: {{ .current.DisableRealtime }}{{ end }}
 {{ if .statsd }}statsd:{{ end }}
 {{ if .statsd }}  enabled: {{ .statsd.Statsd.Enabled }}{{ end }}
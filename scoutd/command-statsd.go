@@ -0,0 +1,229 @@
+package scoutd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+)
+
+// Applies the statsd settings in cfg to a statsd collector, logging any invalid ones.
+// Settings tied to the running daemon, such as gauge persistence, are left to the caller.
+// Invalid source tracking settings are returned as an error instead, as the collector must not
+// be started without the source allowlist: it would accept packets from everyone.
+func ConfigureStatsd(cfg ScoutConfig, sd *collectors.StatsdCollector) error {
+	if cfg.Statsd.TopSources != 0 || cfg.Statsd.SourceRateLimit > 0 || cfg.Statsd.SourceAllow != "" {
+		allow := SplitList(cfg.Statsd.SourceAllow)
+		if err := sd.TrackSources(cfg.Statsd.TopSources, float64(cfg.Statsd.SourceRateLimit), allow); err != nil {
+			return fmt.Errorf("error configuring statsd source tracking: %s", err)
+		}
+	}
+	if err := sd.SetRewriteRules(cfg.Statsd.RewriteRules); err != nil {
+		cfg.Log.Printf("error configuring statsd rewrite rules: %s", err)
+	}
+	if err := sd.SetFilters(cfg.Statsd.Allow, cfg.Statsd.Deny); err != nil {
+		cfg.Log.Printf("error configuring statsd filters: %s", err)
+	}
+	if err := sd.SetTemplates(cfg.Statsd.Templates); err != nil {
+		cfg.Log.Printf("error configuring statsd templates: %s", err)
+	}
+	if cfg.Statsd.HostTags != "false" {
+		sd.SetHostTags(HostTags(cfg))
+	}
+	if err := sd.SetDerivedMetrics(cfg.Statsd.DerivedMetrics); err != nil {
+		cfg.Log.Printf("error configuring statsd derived metrics: %s", err)
+	}
+	sd.SetCounterOptions(cfg.Statsd.CounterRates == "true", cfg.Statsd.Cumulative == "true")
+	if err := sd.SetTypeConflictPolicy(cfg.Statsd.ConflictPolicy); err != nil {
+		cfg.Log.Printf("error configuring statsd type conflict policy: %s", err)
+	}
+	if err := sd.SetHistograms(cfg.Statsd.Histograms); err != nil {
+		cfg.Log.Printf("error configuring statsd histograms: %s", err)
+	}
+	if err := sd.SetMetricOverrides(cfg.Statsd.Overrides); err != nil {
+		cfg.Log.Printf("error configuring statsd overrides: %s", err)
+	}
+	return nil
+}
+
+// Replays a statsd capture file through a collector configured like the daemon's,
+// and prints the resulting payload as json
+func RunStatsdReplay(cfg ScoutConfig) {
+	f, err := os.Open(statsdReplayOptions.Args.File)
+	if err != nil {
+		fmt.Printf("Error opening capture file: %s\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	sd, err := collectors.NewStatsdCollector("statsd", cfg.Statsd.Addr, 60*time.Second, cfg.Statsd.EventLimit)
+	if err != nil {
+		fmt.Printf("Error creating statsd collector: %s\n", err)
+		os.Exit(1)
+	}
+	if err := ConfigureStatsd(cfg, sd); err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	payload, err := sd.Replay(f)
+	if err != nil {
+		fmt.Printf("Error replaying capture: %s\n", err)
+		os.Exit(1)
+	}
+	js, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		fmt.Printf("Error encoding payload: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s\n", js)
+}
+
+// Connects to the running daemon's payload endpoint and prints the statsd events it streams,
+// until interrupted
+func RunStatsdTail(cfg ScoutConfig) {
+	query := url.Values{"match": statsdTailOptions.Match}
+	tailUrl := fmt.Sprintf("http://%s%s?%s", DefaultPayloadAddr, StatsdTailPath, query.Encode())
+	resp, err := http.Get(tailUrl)
+	if err != nil {
+		fmt.Printf("Error connecting to scoutd: %s\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Error from scoutd: %s\n", resp.Status)
+		os.Exit(1)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if statsdTailOptions.JSON {
+			fmt.Printf("%s\n", scanner.Bytes())
+			continue
+		}
+		var rec collectors.TailRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			fmt.Printf("Error reading event: %s\n", err)
+			continue
+		}
+		fmt.Println(formatTailRecord(rec))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Error reading from scoutd: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Formats an event like: 15:04:05.000 Increment requests [path:/] 1
+func formatTailRecord(rec collectors.TailRecord) string {
+	tags := ""
+	if len(rec.Tags) > 0 {
+		tags = " [" + strings.Join(rec.Tags, " ") + "]"
+	}
+	return fmt.Sprintf("%s %s %s%s %v", rec.Time.Local().Format("15:04:05.000"), rec.Type, rec.Name, tags, rec.Value)
+}
+
+// Sends lines in statsd format to the statsd server, one packet per line, or with --check only
+// reports how each line from stdin is parsed. Invalid lines are reported and not sent.
+// Exits with status 1 if any line is invalid.
+func RunStatsdSend(cfg ScoutConfig) {
+	if statsdSendOptions.Check {
+		os.Exit(checkStatsdInput(os.Stdin, os.Stdout))
+	}
+	lines := statsdSendOptions.Args.Lines
+	if len(lines) == 0 {
+		lines = readLines(os.Stdin)
+	}
+
+	addr := statsdSendOptions.Addr
+	if addr == "" {
+		addr = cfg.Statsd.Addr
+	}
+	network, address := "udp", addr
+	if i := strings.Index(addr, "://"); i > 0 {
+		network, address = addr[:i], addr[i+3:] // eg: tcp://127.0.0.1:8125
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		fmt.Printf("Error connecting to %s: %s\n", addr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	valid := true
+	sent := 0
+	for _, line := range lines {
+		if skipStatsdLine(line) {
+			continue
+		}
+		if _, err := collectors.ParseLine(line); err != nil {
+			fmt.Printf("Not sending %q: %s\n", line, err)
+			valid = false
+			continue
+		}
+		if network == "tcp" || network == "unix" {
+			line += "\n" // lines are newline terminated on a stream
+		}
+		if _, err := conn.Write([]byte(line)); err != nil {
+			fmt.Printf("Error sending %q: %s\n", line, err)
+			os.Exit(1)
+		}
+		sent++
+	}
+	fmt.Printf("Sent %d lines to %s\n", sent, addr)
+	if !valid {
+		os.Exit(1)
+	}
+}
+
+// Reports how each line read from r is parsed to w. Returns the exit status of
+// statsd send --check: 1 if any line is invalid.
+func checkStatsdInput(r io.Reader, w io.Writer) int {
+	if !checkStatsdLines(w, readLines(r)) {
+		return 1
+	}
+	return 0
+}
+
+// Writes how each line is parsed to w, returning false if any line is invalid
+func checkStatsdLines(w io.Writer, lines []string) bool {
+	valid := true
+	for i, line := range lines {
+		if skipStatsdLine(line) {
+			continue
+		}
+		e, err := collectors.ParseLine(line)
+		if err != nil {
+			fmt.Fprintf(w, "line %d: invalid: %s: %q\n", i+1, err, line)
+			valid = false
+			continue
+		}
+		tags := ""
+		if len(e.GetTags()) > 0 {
+			tags = " tags=" + strings.Join(e.GetTags(), ",")
+		}
+		fmt.Fprintf(w, "line %d: ok: %s name=%s%s value=%v\n", i+1, e.TypeString(), e.Key(), tags, e.Payload())
+	}
+	return valid
+}
+
+// Whether the collector ignores line, rather than parsing it: it only parses lines of more than
+// one character
+func skipStatsdLine(line string) bool {
+	return len(line) <= 1
+}
+
+// Reads the lines of r, split on newlines only, as the collector splits a packet. Unlike
+// bufio.ScanLines, the \r of a \r\n line ending is kept, as the collector would see it.
+func readLines(r io.Reader) []string {
+	data, _ := ioutil.ReadAll(r)
+	if len(data) == 0 {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
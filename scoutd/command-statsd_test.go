@@ -0,0 +1,67 @@
+package scoutd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckStatsdInput(t *testing.T) {
+	tests := []struct {
+		input  string
+		status int
+		output []string // one per line checked
+	}{
+		{input: "", status: 0, output: []string{}},
+		{input: "requests:1|c\n", status: 0, output: []string{"line 1: ok: Increment name=requests value=1"}},
+		{
+			input:  "requests:1|c\n\nlatency:10|ms|#path:/\n",
+			status: 0,
+			output: []string{"line 1: ok: Increment name=requests value=1", "line 3: ok: Timing name=latency tags=path:/ value="},
+		},
+		{input: "requests:1|c", status: 0, output: []string{"line 1: ok: Increment"}}, // no final newline
+		// The collector only splits on \n, so the \r of a \r\n line ending makes the line invalid
+		{input: "requests:1|c\r\n", status: 1, output: []string{`line 1: invalid: `}},
+		{input: "requests:1|c \n", status: 1, output: []string{`line 1: invalid: `}},
+		{
+			input:  "requests:1|c\nrequests:x|c\n",
+			status: 1,
+			output: []string{"line 1: ok: Increment", `line 2: invalid: `},
+		},
+	}
+	for _, test := range tests {
+		var w bytes.Buffer
+		if status := checkStatsdInput(strings.NewReader(test.input), &w); status != test.status {
+			t.Errorf("Exit status checking %q: %d != %d", test.input, test.status, status)
+		}
+		output := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+		if w.Len() == 0 {
+			output = []string{}
+		}
+		if len(output) != len(test.output) {
+			t.Errorf("Output checking %q: %q", test.input, w.String())
+			continue
+		}
+		for i, prefix := range test.output {
+			if !strings.HasPrefix(output[i], prefix) {
+				t.Errorf("Output checking %q: %q does not start with %q", test.input, output[i], prefix)
+			}
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+	tests := map[string][]string{
+		"":               {},
+		"a:1|c":          {"a:1|c"},
+		"a:1|c\n":        {"a:1|c"},
+		"a:1|c\r\nb:2|c": {"a:1|c\r", "b:2|c"},
+		"a:1|c\n\nb:2|c": {"a:1|c", "", "b:2|c"},
+	}
+	for input, expected := range tests {
+		lines := readLines(strings.NewReader(input))
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") || len(lines) != len(expected) {
+			t.Errorf("Lines of %q: %q != %q", input, expected, lines)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package scoutd
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/pingdomserver/go-gypsy/yaml"
 	"github.com/pingdomserver/mergo"
+
+	"github.com/pingdomserver/scoutd/collectors"
 )
 
 const (
@@ -18,6 +21,10 @@ const (
 	DefaultStatsdAddr  = "127.0.0.1:8125"
 	DefaultPayloadAddr = "127.0.0.1:8126"
 	DefaultEventLimit  = 1000
+	GaugeStateFile     = "statsd_gauges.json" // Created in RunDir
+	StatsdCaptureFile  = "statsd_capture.jsonl"
+	StatsdTailPath     = "/statsd/tail" // On the payload endpoint
+	MetricsPath        = "/metrics"     // On the payload endpoint, for Prometheus
 )
 
 type AgentCheckin struct {
@@ -49,13 +56,37 @@ type ScoutConfig struct {
 	PassthroughOpts    []string
 	SubCommand         string
 	IgnoredDevices     string
+	Tags               map[string]string
 	Statsd             struct {
-		Addr       string
-		Enabled    string
-		EventLimit int
+		Addr            string
+		Enabled         string
+		EventLimit      int
+		TopSources      int
+		SourceRateLimit int
+		SourceAllow     string
+		RewriteRules    []collectors.RewriteRule
+		Allow           []string
+		Deny            []string
+		Templates       []string
+		HostTags        string
+		DerivedMetrics  []collectors.DerivedMetric
+		CounterRates    string
+		Cumulative      string
+		ConflictPolicy  string
+		Histograms      []collectors.HistogramConfig
+		Overrides       []collectors.MetricOverride
+		PersistGauges   string
+		GaugeMaxAge     string
+		CaptureFile     string
+		CaptureDuration string
+		RelayUpstreams  []string
+		RelayMatch      []string
+		RelayBuffer     int
 	}
-	DisableRealtime string
-	HttpClients     struct {
+	Sinks            []map[string]string
+	MetricsSeriesTTL string // how long the Prometheus endpoint keeps a counter series not flushed
+	DisableRealtime  string
+	HttpClients      struct {
 		HttpClient  *http.Client
 		HttpsClient *http.Client
 	}
@@ -95,6 +126,12 @@ func LoadConfig(cfg *ScoutConfig) {
 		log.Fatalf("Error while merging CLI config options: %s\n", err)
 	}
 
+	// Not fatal, as the config is reloaded on SIGHUP. The invalid ones are left out when the
+	// statsd collector is configured.
+	if err := collectors.ValidateDerivedMetrics(cfg.Statsd.DerivedMetrics); err != nil {
+		log.Printf("Error in statsd derived_metrics config, disabling the invalid ones: %s\n", err)
+	}
+
 	// Compile the passthroughOpts the scout ruby agent will need
 	cfg.PassthroughOpts = make([]string, 0) // Make sure we reset to an empty array in case we are reloading the config
 	cfg.PassthroughOpts = append(cfg.PassthroughOpts, "--hostname", cfg.HostName)
@@ -142,6 +179,11 @@ func LoadDefaults() (cfg ScoutConfig) {
 	cfg.Statsd.Enabled = "true"
 	cfg.Statsd.Addr = DefaultStatsdAddr
 	cfg.Statsd.EventLimit = DefaultEventLimit
+	cfg.Statsd.HostTags = "true"
+	cfg.Statsd.PersistGauges = "false"
+	cfg.Statsd.GaugeMaxAge = "1h"
+	cfg.Statsd.CaptureFile = StatsdCaptureFile
+	cfg.MetricsSeriesTTL = "1h"
 	cfg.DisableRealtime = "false"
 	return
 }
@@ -171,8 +213,21 @@ func LoadEnvOpts() (cfg ScoutConfig) {
 	if eventLimit, err := strconv.Atoi(os.Getenv("SCOUT_STATSD_EVENT_LIMIT")); err == nil {
 		cfg.Statsd.EventLimit = eventLimit
 	}
+	if topSources, err := strconv.Atoi(os.Getenv("SCOUT_STATSD_TOP_SOURCES")); err == nil {
+		cfg.Statsd.TopSources = topSources
+	}
+	if rateLimit, err := strconv.Atoi(os.Getenv("SCOUT_STATSD_SOURCE_RATE_LIMIT")); err == nil {
+		cfg.Statsd.SourceRateLimit = rateLimit
+	}
+	cfg.Statsd.SourceAllow = os.Getenv("SCOUT_STATSD_SOURCE_ALLOW")
+	cfg.Statsd.HostTags = os.Getenv("SCOUT_STATSD_HOST_TAGS")
+	cfg.Statsd.PersistGauges = os.Getenv("SCOUT_STATSD_PERSIST_GAUGES")
+	cfg.Statsd.GaugeMaxAge = os.Getenv("SCOUT_STATSD_GAUGE_MAX_AGE")
+	cfg.Statsd.CaptureDuration = os.Getenv("SCOUT_STATSD_CAPTURE_DURATION")
+	cfg.Tags = ParseTags(os.Getenv("SCOUT_TAGS"))
 	cfg.ReportingServerUrl = os.Getenv("SCOUT_REPORTING_SERVER_URL")
 	cfg.LogLevel = os.Getenv("SCOUT_LOG_LEVEL")
+	cfg.MetricsSeriesTTL = os.Getenv("SCOUT_METRICS_SERIES_TTL")
 	cfg.DisableRealtime = os.Getenv("DISABLE_REALTIME")
 	return
 }
@@ -198,16 +253,168 @@ func LoadConfigFile(configFile string) (cfg ScoutConfig) {
 	cfg.ReportingServerUrl, err = conf.Get("reporting_server_url")
 	cfg.LogLevel, err = conf.Get("log_level")
 	cfg.IgnoredDevices, err = conf.Get("ignored_devices")
+	cfg.Tags = loadMap(conf, "tags")
 	cfg.Statsd.Addr, err = conf.Get("statsd.addr")
 	cfg.Statsd.Enabled, err = conf.Get("statsd.enabled")
 	var eventLimit string
 	if eventLimit, err = conf.Get("statsd.event_limit"); err == nil {
 		cfg.Statsd.EventLimit, err = strconv.Atoi(eventLimit)
 	}
+	var topSources string
+	if topSources, err = conf.Get("statsd.top_sources"); err == nil {
+		cfg.Statsd.TopSources, err = strconv.Atoi(topSources)
+	}
+	var sourceRateLimit string
+	if sourceRateLimit, err = conf.Get("statsd.source_rate_limit"); err == nil {
+		cfg.Statsd.SourceRateLimit, err = strconv.Atoi(sourceRateLimit)
+	}
+	cfg.Statsd.SourceAllow, err = conf.Get("statsd.source_allow")
+	cfg.Statsd.RewriteRules = loadRewriteRules(conf)
+	cfg.Statsd.Allow = loadList(conf, "statsd.allow")
+	cfg.Statsd.Deny = loadList(conf, "statsd.deny")
+	cfg.Statsd.Templates = loadList(conf, "statsd.templates")
+	cfg.Statsd.HostTags, err = conf.Get("statsd.host_tags")
+	cfg.Statsd.DerivedMetrics = loadDerivedMetrics(conf)
+	cfg.Statsd.CounterRates, err = conf.Get("statsd.counter_rates")
+	cfg.Statsd.Cumulative, err = conf.Get("statsd.cumulative_counters")
+	cfg.Statsd.ConflictPolicy, err = conf.Get("statsd.type_conflict_policy")
+	cfg.Statsd.Histograms = loadHistograms(conf)
+	cfg.Statsd.Overrides = loadMetricOverrides(conf)
+	cfg.Statsd.PersistGauges, err = conf.Get("statsd.persist_gauges")
+	cfg.Statsd.GaugeMaxAge, err = conf.Get("statsd.gauge_max_age")
+	cfg.Statsd.CaptureFile, err = conf.Get("statsd.capture_file")
+	cfg.Statsd.CaptureDuration, err = conf.Get("statsd.capture_duration")
+	cfg.Statsd.RelayUpstreams = loadList(conf, "statsd.relay.upstreams")
+	cfg.Statsd.RelayMatch = loadList(conf, "statsd.relay.match")
+	var relayBuffer string
+	if relayBuffer, err = conf.Get("statsd.relay.buffer"); err == nil {
+		cfg.Statsd.RelayBuffer, err = strconv.Atoi(relayBuffer)
+	}
+	cfg.Sinks = loadSinks(conf)
+	cfg.MetricsSeriesTTL, err = conf.Get("metrics_series_ttl")
 	cfg.DisableRealtime, err = conf.Get("disable_realtime")
 	return
 }
 
+// Reads a list of strings from the config file
+func loadList(conf *yaml.File, spec string) []string {
+	count, err := conf.Count(spec)
+	if err != nil {
+		return nil
+	}
+	items := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if item, err := conf.Get(fmt.Sprintf("%s[%d]", spec, i)); err == nil && item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Reads a map of strings from the config file
+func loadMap(conf *yaml.File, spec string) map[string]string {
+	node, err := yaml.Child(conf.Root, spec)
+	if err != nil {
+		return nil
+	}
+	m, ok := node.(yaml.Map)
+	if !ok {
+		return nil
+	}
+	items := make(map[string]string, len(m))
+	for k, v := range m {
+		if scalar, ok := v.(yaml.Scalar); ok {
+			items[k] = scalar.String()
+		}
+	}
+	return items
+}
+
+// Reads the ordered statsd.rewrite_rules list. Each item is a map with a type,
+// and the match, replace or value keys that type needs.
+func loadRewriteRules(conf *yaml.File) []collectors.RewriteRule {
+	count, err := conf.Count("statsd.rewrite_rules")
+	if err != nil {
+		return nil
+	}
+	rules := make([]collectors.RewriteRule, count)
+	for i := range rules {
+		spec := fmt.Sprintf("statsd.rewrite_rules[%d]", i)
+		rules[i].Type, _ = conf.Get(spec + ".type")
+		rules[i].Match, _ = conf.Get(spec + ".match")
+		rules[i].Replace, _ = conf.Get(spec + ".replace")
+		rules[i].Value, _ = conf.Get(spec + ".value")
+	}
+	return rules
+}
+
+// Reads the ordered statsd.derived_metrics list. Each item is a map with a name and an expr.
+func loadDerivedMetrics(conf *yaml.File) []collectors.DerivedMetric {
+	count, err := conf.Count("statsd.derived_metrics")
+	if err != nil {
+		return nil
+	}
+	metrics := make([]collectors.DerivedMetric, count)
+	for i := range metrics {
+		spec := fmt.Sprintf("statsd.derived_metrics[%d]", i)
+		metrics[i].Name, _ = conf.Get(spec + ".name")
+		metrics[i].Expr, _ = conf.Get(spec + ".expr")
+	}
+	return metrics
+}
+
+// Reads the statsd.histograms list. Each item is a map with a match pattern,
+// and either fixed buckets or exponential bucket parameters.
+func loadHistograms(conf *yaml.File) []collectors.HistogramConfig {
+	count, err := conf.Count("statsd.histograms")
+	if err != nil {
+		return nil
+	}
+	histograms := make([]collectors.HistogramConfig, count)
+	for i := range histograms {
+		spec := fmt.Sprintf("statsd.histograms[%d]", i)
+		histograms[i].Match, _ = conf.Get(spec + ".match")
+		histograms[i].Buckets, _ = conf.Get(spec + ".buckets")
+		histograms[i].Exponential, _ = conf.Get(spec + ".exponential")
+	}
+	return histograms
+}
+
+// Reads the statsd.overrides list. Each item is a map with a match pattern, and any of
+// stats, percentiles, counter_rates and cumulative_counters.
+func loadMetricOverrides(conf *yaml.File) []collectors.MetricOverride {
+	count, err := conf.Count("statsd.overrides")
+	if err != nil {
+		return nil
+	}
+	overrides := make([]collectors.MetricOverride, count)
+	for i := range overrides {
+		spec := fmt.Sprintf("statsd.overrides[%d]", i)
+		overrides[i].Match, _ = conf.Get(spec + ".match")
+		overrides[i].Stats, _ = conf.Get(spec + ".stats")
+		overrides[i].Percentiles, _ = conf.Get(spec + ".percentiles")
+		overrides[i].CounterRates, _ = conf.Get(spec + ".counter_rates")
+		overrides[i].Cumulative, _ = conf.Get(spec + ".cumulative_counters")
+	}
+	return overrides
+}
+
+// Reads the sinks list. Each item is a map with a type, the queue_size, max_retries and
+// retry_interval delivery options, and the options of that sink type.
+func loadSinks(conf *yaml.File) []map[string]string {
+	count, err := conf.Count("sinks")
+	if err != nil {
+		return nil
+	}
+	sinks := make([]map[string]string, 0, count)
+	for i := 0; i < count; i++ {
+		if options := loadMap(conf, fmt.Sprintf("sinks[%d]", i)); options != nil {
+			sinks = append(sinks, options)
+		}
+	}
+	return sinks
+}
+
 func ConfigureLogger(cfg *ScoutConfig) {
 	var err error
 	if cfg.LogFile == "-" {
@@ -0,0 +1,179 @@
+package scoutd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Set by a running scoutd to the path of the Unix socket its replacement should connect to,
+// to take over its sockets and state on a hot restart.
+const HandoffSocketEnv = "SCOUTD_HANDOFF_SOCKET"
+
+const handoffTimeout = 30 * time.Second
+
+// The listening sockets and aggregation state passed from a running scoutd to the new
+// scoutd process it started on a hot restart. Either socket may be nil.
+type Handoff struct {
+	StatsdSocket    *os.File
+	PayloadListener *os.File
+	StatsdState     []byte
+}
+
+// The message sent over the handoff socket, after a 4 byte length.
+// The file descriptors are sent along with the length, in the order of Files.
+type handoffMessage struct {
+	Files       []string        `json:"files"`
+	StatsdState json.RawMessage `json:"statsd_state,omitempty"`
+}
+
+// Sends h to the new scoutd process connected to conn, and waits for it to acknowledge it
+func SendHandoff(conn *net.UnixConn, h *Handoff) error {
+	msg := handoffMessage{Files: []string{}}
+	fds := []int{}
+	if h.StatsdSocket != nil {
+		msg.Files = append(msg.Files, "statsd")
+		fds = append(fds, int(h.StatsdSocket.Fd()))
+	}
+	if h.PayloadListener != nil {
+		msg.Files = append(msg.Files, "payload")
+		fds = append(fds, int(h.PayloadListener.Fd()))
+	}
+	if h.StatsdState != nil {
+		msg.StatsdState = h.StatsdState
+	}
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(js)))
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	if _, _, err := conn.WriteMsgUnix(length, oob, nil); err != nil {
+		return err
+	}
+	if _, err := conn.Write(js); err != nil {
+		return err
+	}
+	ack := make([]byte, 2)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no acknowledgement from the new process: %s", err)
+	}
+	if string(ack) != "ok" {
+		return fmt.Errorf("unexpected acknowledgement %q", ack)
+	}
+	return nil
+}
+
+// Connects to the handoff socket of the scoutd process being replaced, and receives its
+// sockets and state
+func ReceiveHandoff(path string) (*Handoff, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	length := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(2*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(length, oob)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := parseUnixRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		syscall.CloseOnExec(fd) // not for the child processes
+		files[i] = os.NewFile(uintptr(fd), "handoff")
+	}
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if n < len(length) {
+		if _, err := io.ReadFull(conn, length[n:]); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+	js := make([]byte, binary.BigEndian.Uint32(length))
+	if _, err := io.ReadFull(conn, js); err != nil {
+		closeAll()
+		return nil, err
+	}
+	var msg handoffMessage
+	if err := json.Unmarshal(js, &msg); err != nil {
+		closeAll()
+		return nil, err
+	}
+	if len(files) != len(msg.Files) {
+		closeAll()
+		return nil, fmt.Errorf("expected %d file descriptors, got %d", len(msg.Files), len(files))
+	}
+
+	h := &Handoff{StatsdState: msg.StatsdState}
+	for i, name := range msg.Files {
+		switch name {
+		case "statsd":
+			h.StatsdSocket = files[i]
+		case "payload":
+			h.PayloadListener = files[i]
+		default:
+			files[i].Close()
+		}
+	}
+	if _, err := conn.Write([]byte("ok")); err != nil {
+		closeAll()
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseUnixRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	fds := []int{}
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// Tells systemd that pid is now the main process of the scoutd service, so that it keeps
+// tracking scoutd once the process that started pid for a hot restart exits. The unit must
+// allow it with NotifyAccess=main or NotifyAccess=all. Does nothing if scoutd was not started
+// by systemd.
+func NotifyMainPID(pid int) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"}) // a leading @ is an abstract socket
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("MAINPID=" + strconv.Itoa(pid)))
+	return err
+}
@@ -0,0 +1,100 @@
+package scoutd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "handoff.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+	f, err := statsd.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			sent <- err
+			return
+		}
+		defer conn.Close()
+		sent <- SendHandoff(conn, &Handoff{StatsdSocket: f, StatsdState: []byte(`{"events":[]}`)})
+	}()
+	h, err := ReceiveHandoff(path)
+	if err != nil {
+		t.Fatalf("ReceiveHandoff: %s", err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatalf("SendHandoff: %s", err)
+	}
+	if h.PayloadListener != nil {
+		t.Errorf("Received a payload listener that was not sent")
+	}
+	if string(h.StatsdState) != `{"events":[]}` {
+		t.Errorf("Received statsd state %s", h.StatsdState)
+	}
+	conn, err := net.FilePacketConn(h.StatsdSocket)
+	h.StatsdSocket.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().String() != statsd.LocalAddr().String() {
+		t.Errorf("Received statsd socket %s != %s", conn.LocalAddr(), statsd.LocalAddr())
+	}
+}
+
+func TestNotifyMainPID(t *testing.T) {
+	defer os.Setenv("NOTIFY_SOCKET", os.Getenv("NOTIFY_SOCKET"))
+	os.Setenv("NOTIFY_SOCKET", "")
+	if err := NotifyMainPID(1234); err != nil {
+		t.Errorf("Error without systemd: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "scoutd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+	if err := NotifyMainPID(1234); err != nil {
+		t.Fatalf("NotifyMainPID: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "MAINPID=1234" {
+		t.Errorf("Notification %q", got)
+	}
+}
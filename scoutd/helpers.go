@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -66,6 +67,54 @@ func GetRubyPath(checkPath string) (string, error) {
 	return rubyPath, nil
 }
 
+// Splits a comma separated config value into its trimmed, non-empty items
+func SplitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Parses a comma separated list of key:value tags into a map
+func ParseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, item := range SplitList(s) {
+		kv := strings.SplitN(item, ":", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// Returns the tags appended to every reported metric: the configured tags, plus the hostname,
+// environment and roles unless a configured tag already uses that key.
+// Tags are returned in "key:value" form, sorted so they are reported in a stable order.
+func HostTags(cfg ScoutConfig) []string {
+	tags := []string{}
+	for k, v := range cfg.Tags {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	if _, ok := cfg.Tags["host"]; !ok && cfg.HostName != "" {
+		tags = append(tags, "host:"+cfg.HostName)
+	}
+	if _, ok := cfg.Tags["environment"]; !ok && cfg.AgentEnv != "" {
+		tags = append(tags, "environment:"+cfg.AgentEnv)
+	}
+	if _, ok := cfg.Tags["role"]; !ok {
+		for _, role := range SplitList(cfg.AgentRoles) {
+			tags = append(tags, "role:"+role)
+		}
+	}
+	return tags
+}
 
 func DurationToNextMinute() time.Duration {
 	return time.Duration(60 - time.Now().Second())
@@ -20,7 +20,7 @@ type ApplicationOptions struct {
 	HttpProxyUrl       string `long:"http-proxy" description:"Optional http proxy for non-SSL traffic"`
 	HttpsProxyUrl      string `long:"https-proxy" description:"Optional https proxy for SSL traffic."`
 	StatsdEnabled      string `long:"statsd-enabled" description:"Enable/disable the built-in statsd server. Set to 'false' to disable. Default: 'true'"`
-	StatsdAddr         string `long:"statsd-addr" description:"UDP address and port on which the built-in statsd server will listen. Default: '127.0.0.1:8125'"`
+	StatsdAddr         string `long:"statsd-addr" description:"Address on which the built-in statsd server will listen. UDP unless prefixed with tcp://, unix:// or unixgram://. Default: '127.0.0.1:8125'"`
 	ReportingServerUrl string `short:"s" long:"server" description:"The URL for the server to report to."`
 	LogLevel           string `short:"l" long:"log-level" description:"Log verbosity. Currently only 'debug' supported."`
 }
@@ -55,5 +55,8 @@ func ParseOptions() (cfg ScoutConfig) {
 	cfg.ReportingServerUrl = cliOpts.ReportingServerUrl
 	cfg.LogLevel = cliOpts.LogLevel
 	cfg.SubCommand = parser.Command.Active.Name
+	if sub := parser.Command.Active.Active; sub != nil {
+		cfg.SubCommand += " " + sub.Name // eg: "statsd replay"
+	}
 	return
 }
@@ -0,0 +1,36 @@
+package scoutd
+
+type StatsdCommandOptions struct {
+	// no options for the statsd command, only its subcommands
+}
+
+type StatsdReplayOptions struct {
+	Args struct {
+		File string `description:"Capture file written by the statsd capture mode"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type StatsdTailOptions struct {
+	Match []string `short:"m" long:"match" description:"Only show metrics whose names match PATTERN, a glob or a /regex/. May be given more than once" value-name:"PATTERN"`
+	JSON  bool     `long:"json" description:"Print each event as a json object"`
+}
+
+type StatsdSendOptions struct {
+	Addr  string `short:"a" long:"addr" description:"Send to this address instead of the configured statsd address. UDP unless prefixed with tcp://, unix:// or unixgram://" value-name:"ADDR"`
+	Check bool   `long:"check" description:"Don't send anything, report how each line read from stdin is parsed"`
+	Args  struct {
+		Lines []string `description:"Lines in statsd format, eg: requests:1|c. Read from stdin if none are given"`
+	} `positional-args:"yes"`
+}
+
+var statsdReplayOptions StatsdReplayOptions
+var statsdSendOptions StatsdSendOptions
+var statsdTailOptions StatsdTailOptions
+
+func init() {
+	var statsdCmdOptions StatsdCommandOptions
+	statsdCmd, _ := parser.AddCommand("statsd", "Statsd debugging tools", "", &statsdCmdOptions)
+	statsdCmd.AddCommand("replay", "Replay a statsd capture file and print the resulting payload", "", &statsdReplayOptions)
+	statsdCmd.AddCommand("send", "Send lines in statsd format to the statsd server, or check them with --check", "", &statsdSendOptions)
+	statsdCmd.AddCommand("tail", "Stream the statsd events received by the running daemon", "", &statsdTailOptions)
+}
@@ -0,0 +1,258 @@
+package sinks
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+)
+
+const fileRotatedFormat = "20060102-150405"
+
+func init() {
+	Register("file", func(options map[string]string) (Sink, error) {
+		return NewFileSink(options)
+	})
+}
+
+// One line of a file sink: the checkin bundle of a flush, with the time it was written
+type fileRecord struct {
+	Time time.Time `json:"time"`
+	collectors.PayloadBundle
+}
+
+// Appends every flushed payload set to a file as one json line. The file is rotated when it
+// would grow past a size, or once it is older than an age, by renaming it with the time of
+// the rotation, eg: statsd.jsonl.20261019-133700, and optionally gzipping it.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	maxFiles int
+	now      func() time.Time
+
+	file    *os.File
+	size    int64
+	started time.Time // the time of the file's first line
+}
+
+// Creates a file sink from its options:
+//
+//	path:      the file to append to. Relative paths are in run_dir, if given
+//	max_size:  rotate before the file grows past this size, eg: 100MB. No limit by default
+//	max_age:   rotate once the first line of the file is this old, eg: 24h. No limit by default
+//	compress:  "true" to gzip rotated files
+//	max_files: how many rotated files to keep. All of them by default
+func NewFileSink(options map[string]string) (*FileSink, error) {
+	s := &FileSink{path: options["path"], compress: options["compress"] == "true", now: time.Now}
+	if s.path == "" {
+		return nil, fmt.Errorf("file sink needs a path")
+	}
+	if !filepath.IsAbs(s.path) && options["run_dir"] != "" {
+		s.path = filepath.Join(options["run_dir"], s.path)
+	}
+	var err error
+	if v := options["max_size"]; v != "" {
+		if s.maxSize, err = parseSize(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := options["max_age"]; v != "" {
+		if s.maxAge, err = time.ParseDuration(v); err != nil || s.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid file max_age %q", v)
+		}
+	}
+	if v := options["max_files"]; v != "" {
+		if s.maxFiles, err = strconv.Atoi(v); err != nil || s.maxFiles < 1 {
+			return nil, fmt.Errorf("invalid file max_files %q", v)
+		}
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Write(payloads []*collectors.CollectorPayload) error {
+	now := s.now()
+	line, err := json.Marshal(fileRecord{
+		Time:          now.UTC(),
+		PayloadBundle: collectors.PayloadBundle{SchemaVersion: collectors.PayloadSchemaVersion, Collectors: finitePayloads(payloads)},
+	})
+	if err != nil {
+		return Permanent(err)
+	}
+	line = append(line, '\n')
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && (s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize || s.maxAge > 0 && now.Sub(s.started) >= s.maxAge) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if s.size == int64(n) {
+		s.started = now
+	}
+	return err
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Opens the file for appending, finding when it was started if it already has lines
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size, s.started = file, info.Size(), info.ModTime()
+	if s.size > 0 {
+		if started, err := firstLineTime(s.path); err == nil {
+			s.started = started
+		}
+	}
+	return nil
+}
+
+// Returns the time of the first record in the file at path
+func firstLineTime(path string) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return time.Time{}, err
+	}
+	var record struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(line, &record); err != nil {
+		return time.Time{}, err
+	}
+	return record.Time, nil
+}
+
+// Renames the current file with the time, compresses it if need be, removes the oldest rotated
+// files beyond maxFiles, and opens a new file
+func (s *FileSink) rotate(now time.Time) error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	rotated := s.path + "." + now.Format(fileRotatedFormat)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", s.path, now.Format(fileRotatedFormat), i)
+	}
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	if s.compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Printf("file sink: error compressing %s: %s", rotated, err)
+		}
+	}
+	if s.maxFiles > 0 {
+		s.removeOldFiles()
+	}
+	return s.open()
+}
+
+// Removes the oldest rotated files, so at most maxFiles are left
+func (s *FileSink) removeOldFiles() {
+	matches, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return
+	}
+	rotated := []string{}
+	for _, m := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(m, s.path+"."), ".gz")
+		if len(suffix) >= len(fileRotatedFormat) {
+			if _, err := time.Parse(fileRotatedFormat, suffix[:len(fileRotatedFormat)]); err == nil {
+				rotated = append(rotated, m)
+			}
+		}
+	}
+	sort.Strings(rotated) // the names sort by rotation time
+	for i := 0; i < len(rotated)-s.maxFiles; i++ {
+		if err := os.Remove(rotated[i]); err != nil {
+			log.Printf("file sink: error removing %s: %s", rotated[i], err)
+		}
+	}
+}
+
+// Replaces the file at path with path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Parses a size in bytes, with an optional KB, MB or GB suffix, eg: 100MB
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.ToUpper(strings.TrimSpace(size))
+	for suffix, m := range map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30} {
+		if strings.HasSuffix(number, suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, suffix)), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSuffix(number, "B"), 10, 64)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,172 @@
+package sinks
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func readRecords(t *testing.T, path string) []fileRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var r *bufio.Scanner
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bufio.NewScanner(gz)
+	} else {
+		r = bufio.NewScanner(file)
+	}
+	records := []fileRecord{}
+	for r.Scan() {
+		var record fileRecord
+		if err := json.Unmarshal(r.Bytes(), &record); err != nil {
+			t.Fatalf("invalid line %q: %s", r.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "scoutd-file-sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.jsonl")
+	s, err := NewFileSink(map[string]string{"path": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(statsdPayload(&event.Metric{Name: "a", Value: 1, Type: "gauge"}))
+	s.Close()
+	// A new sink appends to the existing file
+	s, _ = NewFileSink(map[string]string{"path": path})
+	s.Write(statsdPayload(&event.Metric{Name: "b", Value: 2, Type: "gauge"}))
+	s.Close()
+
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0].Collectors[0].Metrics[0].Name != "a" || records[1].Collectors[0].Metrics[0].Name != "b" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if records[0].SchemaVersion != 2 || records[0].Time.IsZero() {
+		t.Errorf("expected a schema version and time, got %+v", records[0])
+	}
+}
+
+func TestFileSinkNonFinite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	// A relative path is in the RunDir
+	s, err := NewFileSink(map[string]string{"path": "statsd.jsonl", "run_dir": dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := statsdPayload(&event.Metric{Name: "a", Value: 1, Type: "gauge"}, &event.Metric{Name: "b", Value: math.NaN(), Type: "gauge"})
+	if err := s.Write(payloads); err != nil {
+		t.Fatalf("write with a NaN value: %s", err)
+	}
+	s.Close()
+
+	records := readRecords(t, filepath.Join(dir, "statsd.jsonl"))
+	if len(records) != 1 || len(records[0].Collectors[0].Metrics) != 1 || records[0].Collectors[0].Metrics[0].Name != "a" {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if len(payloads[0].Metrics) != 2 {
+		t.Errorf("the payload shared with the other sinks was changed")
+	}
+}
+
+func TestFileSinkRotatesBySize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.jsonl")
+	s, err := NewFileSink(map[string]string{"path": path, "max_size": "450", "compress": "true", "max_files": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	for i := 0; i < 8; i++ { // 219 bytes each, so 2 to a file
+		s.Write(statsdPayload(&event.Metric{Name: "a", Value: float64(i), Type: "gauge"}))
+		now = now.Add(time.Minute)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	expected := []string{path + ".20261019-130400.gz", path + ".20261019-130600.gz"}
+	if len(rotated) != 2 || rotated[0] != expected[0] || rotated[1] != expected[1] {
+		t.Fatalf("expected the newest 2 rotated files %v, got %v", expected, rotated)
+	}
+	records := readRecords(t, rotated[1])
+	if len(records) != 2 || records[0].Collectors[0].Metrics[0].Value != 4 {
+		t.Errorf("unexpected records in %s: %+v", rotated[1], records)
+	}
+	if records := readRecords(t, path); len(records) != 2 || records[1].Collectors[0].Metrics[0].Value != 7 {
+		t.Errorf("unexpected records in the current file: %+v", records)
+	}
+}
+
+func TestFileSinkRotatesByAge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "statsd.jsonl")
+	now := time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)
+	s, err := NewFileSink(map[string]string{"path": path, "max_age": "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	s.Write(statsdPayload())
+	s.Close()
+
+	// The age comes from the first line, so it survives a restart
+	s, _ = NewFileSink(map[string]string{"path": path, "max_age": "1h"})
+	defer s.Close()
+	now = now.Add(30 * time.Minute)
+	s.now = func() time.Time { return now }
+	s.Write(statsdPayload())
+	if rotated, _ := filepath.Glob(path + ".*"); len(rotated) != 0 {
+		t.Fatalf("expected no rotation within max_age, got %v", rotated)
+	}
+	now = now.Add(30 * time.Minute)
+	s.Write(statsdPayload())
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 1 || rotated[0] != path+".20261019-140000" || len(readRecords(t, rotated[0])) != 2 {
+		t.Errorf("expected one rotated file of 2 records, got %v", rotated)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	sizes := map[string]int64{"100": 100, "10KB": 10 << 10, "5 mb": 5 << 20, "1GB": 1 << 30}
+	for size, expected := range sizes {
+		if n, err := parseSize(size); err != nil || n != expected {
+			t.Errorf("expected %d for %q, got %d, %v", expected, size, n, err)
+		}
+	}
+	for _, size := range []string{"", "MB", "-1", "1TB"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("expected an error for %q", size)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package sinks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+)
+
+const (
+	DefaultGraphiteBuffer = 100000 // metrics
+	graphiteBatchSize     = 500
+	graphiteTimeout       = 10 * time.Second
+	graphiteMaxBackoff    = time.Minute
+)
+
+var graphiteMinBackoff = time.Second
+
+func init() {
+	Register("graphite", func(options map[string]string) (Sink, error) {
+		return NewGraphiteSink(options)
+	})
+}
+
+type graphiteMetric struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+// Sends flushed metrics to a carbon server over TCP, in the plaintext or pickle protocol.
+// Metrics are buffered in memory while the server cannot be reached, up to a limit after which
+// the oldest are dropped, and the connection is retried with exponential backoff.
+type GraphiteSink struct {
+	addr      string
+	pickle    bool
+	prefix    string
+	tags      bool
+	maxBuffer int
+
+	mutex   sync.Mutex
+	buffer  []graphiteMetric
+	dropped int64
+	conn    net.Conn
+	wake    chan bool
+	done    chan bool
+	stopped chan bool
+}
+
+// Creates a graphite sink from its options:
+//
+//	addr:     the carbon server, host:port. The port defaults to 2003, or 2004 for pickle
+//	protocol: plaintext (the default) or pickle
+//	prefix:   prepended to every metric path. {hostname} is replaced by the host name
+//	tags:     "false" to leave tags out of the paths, rather than use graphite's tag syntax
+//	buffer:   how many metrics to hold while the server is unreachable
+func NewGraphiteSink(options map[string]string) (*GraphiteSink, error) {
+	s := &GraphiteSink{
+		addr:      options["addr"],
+		tags:      options["tags"] != "false",
+		maxBuffer: DefaultGraphiteBuffer,
+		wake:      make(chan bool, 1),
+		done:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+	port := "2003"
+	switch options["protocol"] {
+	case "", "plaintext":
+	case "pickle":
+		s.pickle = true
+		port = "2004"
+	default:
+		return nil, fmt.Errorf("unknown graphite protocol %q, expected plaintext or pickle", options["protocol"])
+	}
+	if s.addr == "" {
+		return nil, fmt.Errorf("graphite sink needs an addr")
+	}
+	if _, _, err := net.SplitHostPort(s.addr); err != nil {
+		s.addr = net.JoinHostPort(s.addr, port)
+	}
+	if prefix := options["prefix"]; prefix != "" {
+		hostname := strings.Replace(options["hostname"], ".", "_", -1)
+		s.prefix = strings.TrimSuffix(strings.Replace(prefix, "{hostname}", hostname, -1), ".") + "."
+	}
+	if v := options["buffer"]; v != "" {
+		var err error
+		if s.maxBuffer, err = strconv.Atoi(v); err != nil || s.maxBuffer < 1 {
+			return nil, fmt.Errorf("invalid graphite buffer %q", v)
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *GraphiteSink) Name() string {
+	return "graphite"
+}
+
+// Buffers the metrics for the sender. Never fails, as the sender does its own retries.
+func (s *GraphiteSink) Write(payloads []*collectors.CollectorPayload) error {
+	now := time.Now().Unix()
+	metrics := []graphiteMetric{}
+	for _, p := range finitePayloads(payloads) { // graphite would store NaN and +Inf as written
+		for _, m := range p.Metrics {
+			timestamp := m.WindowEnd
+			if timestamp == 0 {
+				timestamp = now
+			}
+			metrics = append(metrics, graphiteMetric{path: s.path(m.Name, m.Tags), value: m.Value, timestamp: timestamp})
+		}
+	}
+	s.mutex.Lock()
+	s.buffer = append(s.buffer, metrics...)
+	s.trimBuffer()
+	s.mutex.Unlock()
+	select {
+	case s.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// Sends what it can of the buffer, and closes the connection
+func (s *GraphiteSink) Close() error {
+	close(s.done)
+	<-s.stopped
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// Drops the oldest buffered metrics beyond maxBuffer. The mutex must be held.
+func (s *GraphiteSink) trimBuffer() {
+	if over := len(s.buffer) - s.maxBuffer; over > 0 {
+		s.buffer = append([]graphiteMetric{}, s.buffer[over:]...)
+		s.dropped += int64(over)
+		log.Printf("graphite sink: buffer full, dropped %d metrics (%d in total)", over, s.dropped)
+	}
+}
+
+// Sends the buffer whenever metrics are written, backing off while sending fails
+func (s *GraphiteSink) run() {
+	defer close(s.stopped)
+	backoff := graphiteMinBackoff
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			s.send() // one last attempt
+			return
+		}
+		for {
+			err := s.send()
+			if err == nil {
+				backoff = graphiteMinBackoff
+				break
+			}
+			log.Printf("graphite sink: error sending to %s, retrying in %s: %s", s.addr, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			if backoff *= 2; backoff > graphiteMaxBackoff {
+				backoff = graphiteMaxBackoff
+			}
+		}
+	}
+}
+
+// Sends the buffered metrics in batches, connecting first if need be. On error, the unsent
+// batch goes back at the front of the buffer.
+func (s *GraphiteSink) send() error {
+	for {
+		s.mutex.Lock()
+		n := len(s.buffer)
+		if n > graphiteBatchSize {
+			n = graphiteBatchSize
+		}
+		batch := s.buffer[:n:n]
+		s.buffer = s.buffer[n:]
+		s.mutex.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := s.sendBatch(batch); err != nil {
+			s.mutex.Lock()
+			s.buffer = append(batch, s.buffer...)
+			s.trimBuffer()
+			s.mutex.Unlock()
+			return err
+		}
+	}
+}
+
+func (s *GraphiteSink) sendBatch(batch []graphiteMetric) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.addr, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	var data []byte
+	if s.pickle {
+		data = graphitePickle(batch)
+	} else {
+		data = graphitePlaintext(batch)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := s.conn.Write(data); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Returns the graphite path of a metric: the prefix, the name with the characters graphite
+// does not allow replaced, and the tags in graphite's name;tag=value syntax, sorted
+func (s *GraphiteSink) path(name string, tags []string) string {
+	path := s.prefix + graphiteReplacer.Replace(name)
+	if !s.tags || len(tags) == 0 {
+		return path
+	}
+	pairs := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key != "" && value != "" {
+			pairs = append(pairs, graphiteTagReplacer.Replace(key)+"="+graphiteTagReplacer.Replace(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(append([]string{path}, pairs...), ";")
+}
+
+var graphiteReplacer = strings.NewReplacer(" ", "_", ";", "_", "\n", "_", "\t", "_", "/", "-")
+var graphiteTagReplacer = strings.NewReplacer(" ", "_", ";", "_", "\n", "_", "\t", "_", "=", "_", "~", "_", "!", "_", "^", "_")
+
+// Encodes metrics in the plaintext protocol: "path value timestamp" lines
+func graphitePlaintext(metrics []graphiteMetric) []byte {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		fmt.Fprintf(&buf, "%s %s %d\n", m.path, strconv.FormatFloat(m.value, 'f', -1, 64), m.timestamp)
+	}
+	return buf.Bytes()
+}
+
+// Encodes metrics in the pickle protocol: a 4 byte big-endian length, followed by a protocol 2
+// pickle of a list of (path, (timestamp, value)) tuples
+func graphitePickle(metrics []graphiteMetric) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0, 0, 0, 0}) // the length, filled in below
+	buf.Write([]byte{0x80, 2})    // PROTO 2
+	buf.WriteByte(']')            // EMPTY_LIST
+	buf.WriteByte('(')            // MARK
+	for _, m := range metrics {
+		buf.WriteByte('X') // BINUNICODE
+		binary.Write(&buf, binary.LittleEndian, uint32(len(m.path)))
+		buf.WriteString(m.path)
+		if m.timestamp >= math.MinInt32 && m.timestamp <= math.MaxInt32 {
+			buf.WriteByte('J') // BININT
+			binary.Write(&buf, binary.LittleEndian, int32(m.timestamp))
+		} else {
+			buf.WriteByte('G') // BINFLOAT
+			binary.Write(&buf, binary.BigEndian, float64(m.timestamp))
+		}
+		buf.WriteByte('G')
+		binary.Write(&buf, binary.BigEndian, m.value)
+		buf.WriteByte(0x86) // TUPLE2 (timestamp, value)
+		buf.WriteByte(0x86) // TUPLE2 (path, (timestamp, value))
+	}
+	buf.WriteByte('e') // APPENDS
+	buf.WriteByte('.') // STOP
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data
+}
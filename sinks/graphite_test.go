@@ -0,0 +1,144 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func TestGraphitePlaintext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := NewGraphiteSink(map[string]string{"addr": l.Addr().String(), "prefix": "scout.{hostname}", "hostname": "web.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(statsdPayload(
+		&event.Metric{Name: "api.requests", Value: 3, Type: "counter", Tags: []string{"region:eu west", "env:prod"}, WindowEnd: 1000},
+		&event.Metric{Name: "ratio", Value: math.NaN(), Type: "gauge", WindowEnd: 1000},
+		&event.Metric{Name: "limit", Value: math.Inf(1), Type: "gauge", WindowEnd: 1000},
+		&event.Metric{Name: "disk/used", Value: 0.25, Type: "gauge", WindowEnd: 1000},
+	))
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{
+		"scout.web_1.api.requests;env=prod;region=eu_west 3 1000\n",
+		"scout.web_1.disk-used 0.25 1000\n",
+	} {
+		if line, err := r.ReadString('\n'); err != nil || line != expected {
+			t.Errorf("expected %q, got %q, %v", expected, line, err)
+		}
+	}
+}
+
+func TestGraphitePickle(t *testing.T) {
+	data := graphitePickle([]graphiteMetric{{path: "a.b", value: 1.5, timestamp: 1000}})
+	expected := []byte{
+		0, 0, 0, 30, // length
+		0x80, 2, ']', '(',
+		'X', 3, 0, 0, 0, 'a', '.', 'b',
+		'J', 0xe8, 3, 0, 0,
+		'G', 0x3f, 0xf8, 0, 0, 0, 0, 0, 0,
+		0x86, 0x86, 'e', '.',
+	}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("expected % x, got % x", expected, data)
+	}
+	if _, err := NewGraphiteSink(map[string]string{"addr": "localhost", "protocol": "json"}); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+	s, err := NewGraphiteSink(map[string]string{"addr": "localhost", "protocol": "pickle"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.addr != "localhost:2004" {
+		t.Errorf("expected the pickle port by default, got %s", s.addr)
+	}
+}
+
+func TestGraphiteReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close() // nothing listening yet
+
+	defer func(backoff time.Duration) { graphiteMinBackoff = backoff }(graphiteMinBackoff)
+	graphiteMinBackoff = 10 * time.Millisecond
+	s, err := NewGraphiteSink(map[string]string{"addr": addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(statsdPayload(&event.Metric{Name: "up", Value: 1, Type: "gauge", WindowEnd: 1000}))
+
+	time.Sleep(50 * time.Millisecond)
+	if l, err = net.Listen("tcp", addr); err != nil {
+		t.Skipf("could not listen on %s again: %s", addr, err)
+	}
+	defer l.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "up 1 1000\n" {
+		t.Errorf("expected the buffered metric after reconnecting, got %q, %v", line, err)
+	}
+}
+
+func TestGraphiteBuffer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	defer func(backoff time.Duration) { graphiteMinBackoff = backoff }(graphiteMinBackoff)
+	graphiteMinBackoff = time.Hour
+	s, err := NewGraphiteSink(map[string]string{"addr": addr, "buffer": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Write(statsdPayload(
+		&event.Metric{Name: "a", Value: 1, Type: "gauge"},
+		&event.Metric{Name: "b", Value: 2, Type: "gauge"},
+		&event.Metric{Name: "c", Value: 3, Type: "gauge"},
+	))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mutex.Lock()
+		buffered, dropped := append([]graphiteMetric{}, s.buffer...), s.dropped
+		s.mutex.Unlock()
+		if len(buffered) == 2 {
+			if buffered[0].path != "b" || buffered[1].path != "c" || dropped != 1 {
+				t.Errorf("expected the newest 2 metrics to be kept, got %v, %d dropped", buffered, dropped)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 buffered metrics, got %v", buffered)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
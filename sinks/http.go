@@ -0,0 +1,66 @@
+package sinks
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/pingdomserver/scoutd/collectors"
+)
+
+// Serves the latest flushed payload of each collector as a json checkin bundle. This is the
+// payload endpoint the Ruby scout-client fetches from during its checkin.
+type HTTPSink struct {
+	mutex  sync.RWMutex
+	latest map[string]*collectors.CollectorPayload // by collector name
+	bundle []byte
+}
+
+func NewHTTPSink() *HTTPSink {
+	s := &HTTPSink{latest: make(map[string]*collectors.CollectorPayload)}
+	s.Write([]*collectors.CollectorPayload{})
+	return s
+}
+
+func (s *HTTPSink) Name() string {
+	return "http"
+}
+
+func (s *HTTPSink) Write(payloads []*collectors.CollectorPayload) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range finitePayloads(payloads) {
+		s.latest[p.Name] = p
+	}
+	names := make([]string, 0, len(s.latest))
+	for name := range s.latest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	bundle := collectors.PayloadBundle{
+		SchemaVersion: collectors.PayloadSchemaVersion,
+		Collectors:    make([]*collectors.CollectorPayload, len(names)),
+	}
+	for i, name := range names {
+		bundle.Collectors[i] = s.latest[name]
+	}
+	js, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	s.bundle = js
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
+
+func (s *HTTPSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	js := s.bundle
+	s.mutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
@@ -0,0 +1,172 @@
+package sinks
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+const (
+	DefaultInfluxBatchSize  = 5000    // lines
+	DefaultInfluxBatchBytes = 1 << 20 // before compression
+	influxTimeout           = 10 * time.Second
+)
+
+func init() {
+	Register("influxdb", func(options map[string]string) (Sink, error) {
+		return NewInfluxSink(options)
+	})
+}
+
+// Posts flushed metrics in InfluxDB line protocol to a write endpoint, in batches.
+// Each metric is a point of the measurement of its name, with its tags and a value field.
+// Writing the same point again replaces it, so a retried write that was partly done
+// does not duplicate anything.
+type InfluxSink struct {
+	url        string
+	token      string
+	gzip       bool
+	batchSize  int
+	batchBytes int
+	client     *http.Client
+}
+
+// Creates an influxdb sink from its options:
+//
+//	url:         the write endpoint, eg: http://localhost:8086/write?db=scout for InfluxDB 1.x or
+//	             http://localhost:8086/api/v2/write?org=ops&bucket=scout for 2.x
+//	token:       sent in the Authorization header, if set
+//	gzip:        "true" to compress the requests
+//	batch_size:  the most lines in one request
+//	batch_bytes: the most bytes in one request, before compression
+func NewInfluxSink(options map[string]string) (*InfluxSink, error) {
+	s := &InfluxSink{
+		token:      options["token"],
+		gzip:       options["gzip"] == "true",
+		batchSize:  DefaultInfluxBatchSize,
+		batchBytes: DefaultInfluxBatchBytes,
+		client:     &http.Client{Timeout: influxTimeout},
+	}
+	u, err := url.Parse(options["url"])
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid influxdb url %q", options["url"])
+	}
+	// Timestamps are in seconds, as that is all the flush window has
+	query := u.Query()
+	query.Set("precision", "s")
+	u.RawQuery = query.Encode()
+	s.url = u.String()
+	if v := options["batch_size"]; v != "" {
+		if s.batchSize, err = strconv.Atoi(v); err != nil || s.batchSize < 1 {
+			return nil, fmt.Errorf("invalid influxdb batch_size %q", v)
+		}
+	}
+	if v := options["batch_bytes"]; v != "" {
+		if s.batchBytes, err = strconv.Atoi(v); err != nil || s.batchBytes < 1 {
+			return nil, fmt.Errorf("invalid influxdb batch_bytes %q", v)
+		}
+	}
+	return s, nil
+}
+
+func (s *InfluxSink) Name() string {
+	return "influxdb"
+}
+
+// Posts the metrics in batches. Stops at the first batch that may succeed if retried, as the
+// Manager will retry the whole write. Batches InfluxDB rejects are skipped.
+func (s *InfluxSink) Write(payloads []*collectors.CollectorPayload) error {
+	now := time.Now().Unix()
+	var rejected error
+	batch := bytes.Buffer{}
+	lines := 0
+	for _, p := range payloads {
+		for _, m := range p.Metrics {
+			line := influxLine(m, now)
+			if line == "" {
+				continue
+			}
+			if len(line) > s.batchBytes {
+				log.Printf("influxdb sink: skipping %s, its line is over batch_bytes", m.Name)
+				continue
+			}
+			if lines == s.batchSize || batch.Len()+len(line) > s.batchBytes {
+				if err := s.post(batch.Bytes()); err != nil {
+					if _, permanent := err.(permanentError); !permanent {
+						return err
+					}
+					rejected = err
+				}
+				batch.Reset()
+				lines = 0
+			}
+			batch.WriteString(line)
+			lines++
+		}
+	}
+	if lines > 0 {
+		if err := s.post(batch.Bytes()); err != nil {
+			return err
+		}
+	}
+	return rejected
+}
+
+func (s *InfluxSink) Close() error {
+	return nil
+}
+
+func (s *InfluxSink) post(body []byte) error {
+	headers := map[string]string{"Content-Type": "text/plain; charset=utf-8"}
+	if s.token != "" {
+		headers["Authorization"] = "Token " + s.token
+	}
+	return post(s.client, s.url, body, headers, s.gzip)
+}
+
+// Returns the line protocol line for a metric, eg: "api.requests,env=prod value=3 1500000000",
+// or "" if InfluxDB cannot store its value
+func influxLine(m *event.Metric, now int64) string {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return ""
+	}
+	timestamp := m.WindowEnd
+	if timestamp == 0 {
+		timestamp = now
+	}
+	tags := make(map[string]string, len(m.Tags))
+	for _, tag := range m.Tags {
+		key, value := tag, "true"
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key != "" && value != "" {
+			tags[key] = value
+		}
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var line bytes.Buffer
+	line.WriteString(influxMeasurementReplacer.Replace(m.Name))
+	for _, k := range keys {
+		line.WriteString("," + influxTagReplacer.Replace(k) + "=" + influxTagReplacer.Replace(tags[k]))
+	}
+	fmt.Fprintf(&line, " value=%s %d\n", strconv.FormatFloat(m.Value, 'g', -1, 64), timestamp)
+	return line.String()
+}
+
+var influxMeasurementReplacer = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", "_")
+var influxTagReplacer = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", "_")
@@ -0,0 +1,100 @@
+package sinks
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func TestInfluxLine(t *testing.T) {
+	lines := map[string]*event.Metric{
+		"api.requests,env=prod,region=eu\\ west value=3 1000\n": {Name: "api.requests", Value: 3, Tags: []string{"region:eu west", "env:prod"}, WindowEnd: 1000},
+		"cpu\\,total,a\\=b=c\\,d,canary=true value=0.5 1000\n":  {Name: "cpu,total", Value: 0.5, Tags: []string{"canary", "a=b:c,d"}, WindowEnd: 1000},
+		"no\\ window value=1e+21 42\n":                          {Name: "no window", Value: 1e21},
+	}
+	for expected, m := range lines {
+		if line := influxLine(m, 42); line != expected {
+			t.Errorf("expected %q, got %q", expected, line)
+		}
+	}
+	if line := influxLine(&event.Metric{Name: "nan", Value: math.NaN()}, 42); line != "" {
+		t.Errorf("expected NaN to be skipped, got %q", line)
+	}
+}
+
+func TestInfluxSinkBatches(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	s, err := NewInfluxSink(map[string]string{"url": server.URL + "/write?db=scout", "batch_size": "2", "gzip": "true", "token": "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Write(statsdPayload(
+		&event.Metric{Name: "a", Value: 1, WindowEnd: 1000},
+		&event.Metric{Name: "b", Value: 2, WindowEnd: 1000},
+		&event.Metric{Name: "c", Value: 3, WindowEnd: 1000},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.bodies) != 2 || server.bodies[0] != "a value=1 1000\nb value=2 1000\n" || server.bodies[1] != "c value=3 1000\n" {
+		t.Fatalf("unexpected batches: %q", server.bodies)
+	}
+	r := server.requests[0]
+	if r.URL.Query().Get("db") != "scout" || r.URL.Query().Get("precision") != "s" {
+		t.Errorf("unexpected query %s", r.URL.RawQuery)
+	}
+	if r.Header.Get("Authorization") != "Token secret" {
+		t.Errorf("unexpected Authorization header %q", r.Header.Get("Authorization"))
+	}
+}
+
+func TestInfluxSinkBatchBytes(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	s, err := NewInfluxSink(map[string]string{"url": server.URL, "batch_bytes": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(statsdPayload(
+		&event.Metric{Name: "first", Value: 1, WindowEnd: 1000},  // 20 bytes
+		&event.Metric{Name: "second", Value: 2, WindowEnd: 1000}, // 21 bytes, so a batch of its own
+		&event.Metric{Name: "far_too_long_to_fit_in_a_batch", Value: 3, WindowEnd: 1000},
+	))
+	if len(server.bodies) != 2 || server.bodies[0] != "first value=1 1000\n" || server.bodies[1] != "second value=2 1000\n" {
+		t.Errorf("unexpected batches: %q", server.bodies)
+	}
+}
+
+func TestInfluxSinkErrors(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	s, err := NewInfluxSink(map[string]string{"url": server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloads := statsdPayload(&event.Metric{Name: "a", Value: 1})
+
+	server.status = http.StatusServiceUnavailable
+	if err := s.Write(payloads); err == nil {
+		t.Error("expected an error for a 503")
+	} else if _, permanent := err.(permanentError); permanent {
+		t.Errorf("expected a 503 to be retried: %s", err)
+	}
+
+	server.status = http.StatusBadRequest
+	m := NewManager()
+	m.Add(s, 1, RetryPolicy{MaxRetries: 3, Interval: time.Millisecond})
+	m.Publish(payloads)
+	m.Close(time.Second)
+	if stats := m.Stats()["influxdb"]; stats.Failed != 1 || stats.Retries != 0 {
+		t.Errorf("expected a rejected write not to be retried, got %+v", stats)
+	}
+
+	if _, err := NewInfluxSink(map[string]string{"url": "localhost:8086"}); err == nil {
+		t.Error("expected an error for a url without a scheme")
+	}
+}
@@ -0,0 +1,408 @@
+package sinks
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+const (
+	DefaultOTLPEndpoint = "http://localhost:4318/v1/metrics"
+	otlpTimeout         = 10 * time.Second
+	otlpDelta           = 1 // AGGREGATION_TEMPORALITY_DELTA
+)
+
+func init() {
+	Register("otlp", func(options map[string]string) (Sink, error) {
+		return NewOTLPSink(options)
+	})
+}
+
+// Exports flushed metrics to an OpenTelemetry collector as OTLP/HTTP with JSON encoding.
+// Statsd counters become delta sums, timers become histograms if they have buckets and
+// summaries otherwise, and everything else becomes a gauge.
+type OTLPSink struct {
+	endpoint string
+	headers  map[string]string
+	gzip     bool
+	resource []otlpKeyValue
+	client   *http.Client
+}
+
+// Creates an otlp sink from its options:
+//
+//	endpoint: the OTLP/HTTP metrics url, http://localhost:4318/v1/metrics by default
+//	headers:  extra request headers, as comma separated key=value pairs
+//	gzip:     "true" to compress the requests
+//
+// The resource attributes are host.name, deployment.environment and scout.roles, from the
+// hostname, environment and roles options scoutd sets.
+func NewOTLPSink(options map[string]string) (*OTLPSink, error) {
+	s := &OTLPSink{
+		endpoint: options["endpoint"],
+		headers:  map[string]string{"Content-Type": "application/json"},
+		gzip:     options["gzip"] == "true",
+		client:   &http.Client{Timeout: otlpTimeout},
+	}
+	if s.endpoint == "" {
+		s.endpoint = DefaultOTLPEndpoint
+	}
+	if u, err := url.Parse(s.endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid otlp endpoint %q", s.endpoint)
+	}
+	if options["headers"] != "" {
+		for _, pair := range strings.Split(options["headers"], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("invalid otlp header %q, expected key=value", pair)
+			}
+			s.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	s.resource = []otlpKeyValue{otlpString("service.name", "scoutd")}
+	for _, attr := range [][2]string{{"host.name", "hostname"}, {"deployment.environment", "environment"}, {"scout.roles", "roles"}} {
+		if v := options[attr[1]]; v != "" {
+			s.resource = append(s.resource, otlpString(attr[0], v))
+		}
+	}
+	return s, nil
+}
+
+func (s *OTLPSink) Name() string {
+	return "otlp"
+}
+
+func (s *OTLPSink) Write(payloads []*collectors.CollectorPayload) error {
+	rm := otlpResourceMetrics{Resource: otlpResource{Attributes: s.resource}}
+	for _, p := range payloads {
+		rm.ScopeMetrics = append(rm.ScopeMetrics, otlpScopeMetrics{
+			Scope:   otlpScope{Name: "scoutd/" + p.Name, Version: os.Getenv("SCOUTD_VERSION")},
+			Metrics: otlpMetrics(p.Metrics, time.Now()),
+		})
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{rm}})
+	if err != nil {
+		return Permanent(err)
+	}
+	return post(s.client, s.endpoint, body, s.headers, s.gzip)
+}
+
+func (s *OTLPSink) Close() error {
+	return nil
+}
+
+// An ExportMetricsServiceRequest, in the OTLP JSON encoding
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope     `json:"scope"`
+	Metrics []*otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpString(key, value string) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	kv.Value.StringValue = value
+	return kv
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Gauge     *otlpGauge     `json:"gauge,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+	Summary   *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []*otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int                `json:"aggregationTemporality"`
+	IsMonotonic            bool               `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []*otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []*otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []*otlpSummaryPoint `json:"dataPoints"`
+}
+
+// The fields every kind of data point has. 64 bit integers are strings in OTLP JSON.
+type otlpPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+}
+
+type otlpNumberPoint struct {
+	otlpPoint
+	AsDouble float64 `json:"asDouble"`
+}
+
+type otlpHistogramPoint struct {
+	otlpPoint
+	Count          string    `json:"count"`
+	Sum            float64   `json:"sum"`
+	BucketCounts   []string  `json:"bucketCounts"`
+	ExplicitBounds []float64 `json:"explicitBounds"`
+	Min            *float64  `json:"min,omitempty"`
+	Max            *float64  `json:"max,omitempty"`
+}
+
+type otlpSummaryPoint struct {
+	otlpPoint
+	Count          string         `json:"count"`
+	Sum            float64        `json:"sum"`
+	QuantileValues []otlpQuantile `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// The flattened metrics of one timer series, eg: its .count, .sum and .upper_95
+type otlpTimer struct {
+	name      string
+	point     otlpPoint
+	stats     map[string]float64
+	quantiles map[float64]float64
+	buckets   map[float64]float64 // cumulative counts, by upper bound
+}
+
+// Converts the metrics of a payload to OTLP metrics, merging the flattened metrics of each timer
+// back into one data point. Metrics with a NaN or infinite value are left out.
+func otlpMetrics(metrics []*event.Metric, now time.Time) []*otlpMetric {
+	byName := make(map[string]*otlpMetric)
+	get := func(name string) *otlpMetric {
+		if byName[name] == nil {
+			byName[name] = &otlpMetric{Name: name}
+		}
+		return byName[name]
+	}
+	histograms := make(map[string]bool) // the timers with buckets
+	for _, m := range metrics {
+		if m.Type == "histogram" {
+			histograms[strings.TrimSuffix(m.Name, ".bucket")] = true
+		}
+	}
+	timers := make(map[string]*otlpTimer)
+	timer := func(name string, m *event.Metric) *otlpTimer {
+		key := name + "|" + strings.Join(sortedTags(m.Tags), ",")
+		if timers[key] == nil {
+			timers[key] = &otlpTimer{name: name, point: otlpMetricPoint(m, now), stats: map[string]float64{},
+				quantiles: map[float64]float64{}, buckets: map[float64]float64{}}
+		}
+		return timers[key]
+	}
+
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			continue // json has no NaN or infinity, and one would fail the whole export
+		}
+		switch m.Type {
+		case "counter":
+			sum := get(m.Name)
+			if sum.Sum == nil {
+				sum.Sum = &otlpSum{AggregationTemporality: otlpDelta, IsMonotonic: true}
+			}
+			sum.Sum.DataPoints = append(sum.Sum.DataPoints, &otlpNumberPoint{otlpMetricPoint(m, now), m.Value})
+			continue
+		case "cumulative_counter":
+			continue // the delta sums of the counter itself carry the same data
+		case "histogram":
+			base := strings.TrimSuffix(m.Name, ".bucket")
+			tags, le := []string{}, ""
+			for _, tag := range m.Tags {
+				if strings.HasPrefix(tag, "le:") {
+					le = tag[3:]
+				} else {
+					tags = append(tags, tag)
+				}
+			}
+			bound, err := strconv.ParseFloat(le, 64)
+			if err != nil {
+				continue
+			}
+			withoutLe := *m
+			withoutLe.Tags = tags
+			timer(base, &withoutLe).buckets[bound] = m.Value
+			continue
+		case "timer":
+			i := strings.LastIndex(m.Name, ".")
+			if i < 0 {
+				break
+			}
+			base, stat := m.Name[:i], m.Name[i+1:]
+			switch {
+			case stat == "count" || stat == "sum" || stat == "min" || stat == "max":
+				timer(base, m).stats[stat] = m.Value
+				continue
+			case !histograms[base]:
+				if q, ok := promQuantile(stat); ok {
+					f, _ := strconv.ParseFloat(q, 64)
+					timer(base, m).quantiles[f] = m.Value
+					continue
+				}
+			}
+		}
+		// Gauges, and the timer stats with no place in a histogram or summary, eg: mean
+		gauge := get(m.Name)
+		if gauge.Gauge == nil {
+			gauge.Gauge = &otlpGauge{}
+		}
+		point := otlpMetricPoint(m, now)
+		point.StartTimeUnixNano = ""
+		gauge.Gauge.DataPoints = append(gauge.Gauge.DataPoints, &otlpNumberPoint{point, m.Value})
+	}
+
+	for _, t := range timers {
+		metric := get(t.name)
+		metric.Unit = "ms"
+		if histograms[t.name] {
+			if metric.Histogram == nil {
+				metric.Histogram = &otlpHistogram{AggregationTemporality: otlpDelta}
+			}
+			metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramDataPoint(t))
+			continue
+		}
+		if metric.Summary == nil {
+			metric.Summary = &otlpSummary{}
+		}
+		// Quantiles 0 and 1 are the min and max
+		if min, ok := t.stats["min"]; ok {
+			t.quantiles[0] = min
+		}
+		if max, ok := t.stats["max"]; ok {
+			t.quantiles[1] = max
+		}
+		count := strconv.FormatInt(int64(t.stats["count"]), 10)
+		point := &otlpSummaryPoint{otlpPoint: t.point, Count: count, Sum: t.stats["sum"], QuantileValues: []otlpQuantile{}}
+		for q, v := range t.quantiles {
+			point.QuantileValues = append(point.QuantileValues, otlpQuantile{q, v})
+		}
+		sort.Slice(point.QuantileValues, func(i, j int) bool { return point.QuantileValues[i].Quantile < point.QuantileValues[j].Quantile })
+		metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*otlpMetric, 0, len(names))
+	for _, name := range names {
+		result = append(result, byName[name].oneType())
+	}
+	return result
+}
+
+// Statsd lets one name be used for metrics of different types, but an OTLP metric has one type.
+// Keeps the first of histogram, summary, sum and gauge.
+func (m *otlpMetric) oneType() *otlpMetric {
+	switch {
+	case m.Histogram != nil:
+		m.Summary, m.Sum, m.Gauge = nil, nil, nil
+	case m.Summary != nil:
+		m.Sum, m.Gauge = nil, nil
+	case m.Sum != nil:
+		m.Gauge = nil
+	}
+	return m
+}
+
+// Converts the cumulative bucket counts of a timer to the per bucket counts of an OTLP histogram
+func otlpHistogramDataPoint(t *otlpTimer) *otlpHistogramPoint {
+	// The +Inf bucket counts every value, even when the timer's stats leave out the count
+	count, ok := t.buckets[math.Inf(1)]
+	if !ok {
+		count = t.stats["count"]
+	}
+	point := &otlpHistogramPoint{otlpPoint: t.point, Count: strconv.FormatInt(int64(count), 10), Sum: t.stats["sum"], BucketCounts: []string{}, ExplicitBounds: []float64{}}
+	bounds := make([]float64, 0, len(t.buckets))
+	for bound := range t.buckets {
+		bounds = append(bounds, bound)
+	}
+	sort.Float64s(bounds)
+	previous := 0.0
+	for _, bound := range bounds {
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatInt(int64(t.buckets[bound]-previous), 10))
+		previous = t.buckets[bound]
+		if bound < math.Inf(1) {
+			point.ExplicitBounds = append(point.ExplicitBounds, bound)
+		}
+	}
+	if min, ok := t.stats["min"]; ok {
+		point.Min = &min
+	}
+	if max, ok := t.stats["max"]; ok {
+		point.Max = &max
+	}
+	return point
+}
+
+// Returns the attributes and flush window of a metric as the common fields of a data point
+func otlpMetricPoint(m *event.Metric, now time.Time) otlpPoint {
+	point := otlpPoint{TimeUnixNano: strconv.FormatInt(now.UnixNano(), 10)}
+	if m.WindowEnd != 0 {
+		point.StartTimeUnixNano = strconv.FormatInt(m.WindowStart*int64(time.Second), 10)
+		point.TimeUnixNano = strconv.FormatInt(m.WindowEnd*int64(time.Second), 10)
+	}
+	last := ""
+	for _, tag := range sortedTags(m.Tags) {
+		key, value := tag, "true"
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key != "" && key != last { // attribute keys must be unique, so the first tag wins
+			point.Attributes = append(point.Attributes, otlpString(key, value))
+		}
+		last = key
+	}
+	return point
+}
+
+func sortedTags(tags []string) []string {
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
+}
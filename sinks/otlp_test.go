@@ -0,0 +1,172 @@
+package sinks
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func TestOTLPMetrics(t *testing.T) {
+	timer := &event.Timing{Name: "db.query", Tags: []string{"db:main"}}
+	histogram := &event.Timing{Name: "http.latency", Buckets: []float64{0.5, 10}}
+	for _, v := range []float64{0.1, 5, 50} {
+		timer.Update(event.NewTiming("db.query", v))
+		histogram.Update(event.NewTiming("http.latency", v))
+	}
+	metrics := []*event.Metric{
+		{Name: "api.requests", Value: 3, Type: "counter", Tags: []string{"env:prod", "canary"}, WindowStart: 940, WindowEnd: 1000},
+		{Name: "api.requests.total", Value: 30, Type: "cumulative_counter"},
+		{Name: "queue", Value: 7, Type: "gauge"},
+	}
+	metrics = append(metrics, timer.Metrics()...)
+	metrics = append(metrics, histogram.Metrics()...)
+	js, err := json.Marshal(otlpMetrics(metrics, time.Unix(2000, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []struct {
+		Name    string
+		Unit    string
+		Sum     *otlpSum
+		Gauge   *otlpGauge
+		Summary *struct {
+			DataPoints []struct {
+				Attributes     []otlpKeyValue
+				Count          string
+				Sum            float64
+				QuantileValues []otlpQuantile
+			}
+		}
+		Histogram *struct {
+			AggregationTemporality int
+			DataPoints             []struct {
+				Count          string
+				Sum            float64
+				BucketCounts   []string
+				ExplicitBounds []float64
+				Min, Max       float64
+			}
+		}
+	}
+	if err := json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]int{}
+	for i, m := range decoded {
+		byName[m.Name] = i
+	}
+	if _, ok := byName["api.requests.total"]; ok {
+		t.Error("expected cumulative counters to be left out")
+	}
+
+	sum := decoded[byName["api.requests"]].Sum
+	if sum == nil || !sum.IsMonotonic || sum.AggregationTemporality != otlpDelta || len(sum.DataPoints) != 1 {
+		t.Fatalf("expected a monotonic delta sum for the counter, got %s", js)
+	}
+	p := sum.DataPoints[0]
+	if p.AsDouble != 3 || p.StartTimeUnixNano != "940000000000" || p.TimeUnixNano != "1000000000000" {
+		t.Errorf("unexpected counter data point %+v", p)
+	}
+	if len(p.Attributes) != 2 || p.Attributes[0].Key != "canary" || p.Attributes[0].Value.StringValue != "true" ||
+		p.Attributes[1].Key != "env" || p.Attributes[1].Value.StringValue != "prod" {
+		t.Errorf("unexpected counter attributes %+v", p.Attributes)
+	}
+
+	gauge := decoded[byName["queue"]].Gauge
+	if gauge == nil || gauge.DataPoints[0].AsDouble != 7 || gauge.DataPoints[0].TimeUnixNano != "2000000000000" {
+		t.Errorf("expected a gauge for the gauge, got %s", js)
+	}
+
+	summary := decoded[byName["db.query"]]
+	if summary.Summary == nil || summary.Unit != "ms" || len(summary.Summary.DataPoints) != 1 {
+		t.Fatalf("expected a summary for the timer, got %s", js)
+	}
+	sp := summary.Summary.DataPoints[0]
+	expected := []otlpQuantile{{0, 0.1}, {0.95, 50}, {1, 50}}
+	if sp.Count != "3" || sp.Sum != 55.1 || len(sp.QuantileValues) != 3 || sp.Attributes[0].Key != "db" {
+		t.Errorf("unexpected summary data point %+v", sp)
+	}
+	for i, q := range expected {
+		if i < len(sp.QuantileValues) && sp.QuantileValues[i] != q {
+			t.Errorf("expected quantile %v, got %v", q, sp.QuantileValues[i])
+		}
+	}
+	if _, ok := byName["db.query.mean"]; !ok {
+		t.Error("expected the timer mean as a gauge")
+	}
+
+	h := decoded[byName["http.latency"]].Histogram
+	if h == nil || h.AggregationTemporality != otlpDelta || len(h.DataPoints) != 1 {
+		t.Fatalf("expected a delta histogram for the timer with buckets, got %s", js)
+	}
+	hp := h.DataPoints[0]
+	if hp.Count != "3" || hp.Min != 0.1 || hp.Max != 50 || len(hp.ExplicitBounds) != 2 ||
+		len(hp.BucketCounts) != 3 || hp.BucketCounts[0] != "1" || hp.BucketCounts[1] != "1" || hp.BucketCounts[2] != "1" {
+		t.Errorf("unexpected histogram data point %+v", hp)
+	}
+
+	// A histogram whose stats leave out the count
+	histogram.Stats = []string{"sum"}
+	js, err = json.Marshal(otlpMetrics(histogram.Metrics(), time.Unix(2000, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = nil
+	if err := json.Unmarshal(js, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded[0].Name != "http.latency" || decoded[0].Histogram == nil || decoded[0].Histogram.DataPoints[0].Count != "3" {
+		t.Errorf("expected the histogram count from the +Inf bucket, got %s", js)
+	}
+}
+
+func TestOTLPSink(t *testing.T) {
+	server := newRecordingServer()
+	defer server.Close()
+	s, err := NewOTLPSink(map[string]string{
+		"endpoint":    server.URL + "/v1/metrics",
+		"headers":     "api-key=secret, x-team=ops",
+		"gzip":        "true",
+		"hostname":    "web1",
+		"environment": "production",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The NaN and infinite values are left out, rather than failing the export
+	if err := s.Write(statsdPayload(&event.Metric{Name: "up", Value: 1, Type: "gauge"},
+		&event.Metric{Name: "ratio", Value: math.NaN(), Type: "gauge"},
+		&event.Metric{Name: "requests", Value: math.Inf(1), Type: "counter"})); err != nil {
+		t.Fatal(err)
+	}
+	r := server.requests[0]
+	if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" ||
+		r.Header.Get("Api-Key") != "secret" || r.Header.Get("X-Team") != "ops" {
+		t.Errorf("unexpected request %s %v", r.URL, r.Header)
+	}
+	var req otlpRequest
+	if err := json.Unmarshal([]byte(server.bodies[0]), &req); err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{}
+	for _, kv := range req.ResourceMetrics[0].Resource.Attributes {
+		attrs[kv.Key] = kv.Value.StringValue
+	}
+	if attrs["host.name"] != "web1" || attrs["deployment.environment"] != "production" || attrs["service.name"] != "scoutd" {
+		t.Errorf("unexpected resource attributes %v", attrs)
+	}
+	if _, ok := attrs["scout.roles"]; ok {
+		t.Error("expected no scout.roles attribute without roles")
+	}
+	scope := req.ResourceMetrics[0].ScopeMetrics[0]
+	if scope.Scope.Name != "scoutd/statsd" || len(scope.Metrics) != 1 || scope.Metrics[0].Name != "up" {
+		t.Errorf("unexpected scope metrics %+v", scope)
+	}
+
+	if _, err := NewOTLPSink(map[string]string{"headers": "novalue"}); err == nil {
+		t.Error("expected an error for a header without a value")
+	}
+}
@@ -0,0 +1,323 @@
+package sinks
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// Content types of the Prometheus text exposition format and the OpenMetrics format
+const (
+	PrometheusTextType = "text/plain; version=0.0.4; charset=utf-8"
+	OpenMetricsType    = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// One sample of a Prometheus metric family
+type promPoint struct {
+	family     string // metric family name
+	typ        string // counter, gauge, summary or histogram
+	suffix     string // appended to the family name to give the sample name, eg: "_sum"
+	labels     string // rendered labels from the metric's tags, eg: `env="prod",role="web"`
+	extraName  string // le for histogram buckets, quantile for summary quantiles
+	extraValue string
+	value      float64
+}
+
+func (p promPoint) key() string {
+	return p.family + p.suffix + "{" + p.labels + "," + p.extraName + "=" + p.extraValue + "}"
+}
+
+// Serves the flushed metrics of each collector for Prometheus to scrape, in the Prometheus
+// text exposition format or, if the scraper accepts it, OpenMetrics.
+// Statsd counters are exposed as counters, and timers as summaries, or histograms if they have
+// buckets. Their values are totalled over every flush, so they only go up as Prometheus
+// expects, and every series is kept until it has not been flushed for the series TTL.
+// Everything else is a gauge with the value of the latest flush.
+type PrometheusSink struct {
+	mutex     sync.RWMutex
+	instant   map[string][]promPoint // from the latest flush of each collector, by collector name
+	totals    map[string]*promPoint  // totalled over every flush, by promPoint.key()
+	updated   map[string]time.Time   // when each of totals was last flushed
+	seriesTTL time.Duration
+}
+
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{instant: make(map[string][]promPoint), totals: make(map[string]*promPoint), updated: make(map[string]time.Time)}
+}
+
+// Sets how long a totalled series is kept without being flushed, eg: a counter no longer sent
+// since its collector dropped it. 0, the default, keeps every series.
+func (s *PrometheusSink) SetSeriesTTL(ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seriesTTL = ttl
+}
+
+func (s *PrometheusSink) Name() string {
+	return "prometheus"
+}
+
+func (s *PrometheusSink) Write(payloads []*collectors.CollectorPayload) error {
+	return s.writeAt(payloads, time.Now())
+}
+
+// Like Write(), with the payloads flushed at now
+func (s *PrometheusSink) writeAt(payloads []*collectors.CollectorPayload, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range payloads {
+		instant, totals := promPoints(p.Metrics)
+		s.instant[p.Name] = instant
+		for i := range totals {
+			key := totals[i].key()
+			if t, ok := s.totals[key]; ok {
+				t.value += totals[i].value
+			} else {
+				s.totals[key] = &totals[i]
+			}
+			s.updated[key] = now
+		}
+	}
+	if s.seriesTTL > 0 {
+		for key, updated := range s.updated {
+			if now.Sub(updated) > s.seriesTTL {
+				delete(s.totals, key)
+				delete(s.updated, key)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *PrometheusSink) Close() error {
+	return nil
+}
+
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	if openMetrics {
+		w.Header().Set("Content-Type", OpenMetricsType)
+	} else {
+		w.Header().Set("Content-Type", PrometheusTextType)
+	}
+	s.WriteExposition(w, openMetrics)
+}
+
+// Writes the metrics to w in the Prometheus text exposition format, or OpenMetrics
+func (s *PrometheusSink) WriteExposition(w io.Writer, openMetrics bool) error {
+	s.mutex.RLock()
+	points := make([]promPoint, 0, len(s.totals))
+	for _, t := range s.totals {
+		points = append(points, *t)
+	}
+	for _, instant := range s.instant {
+		points = append(points, instant...)
+	}
+	s.mutex.RUnlock()
+
+	families := make(map[string][]promPoint)
+	for _, p := range points {
+		if f := families[p.family]; len(f) > 0 && f[0].typ != p.typ {
+			continue // A family can only have one type, so the first one seen wins
+		}
+		families[p.family] = append(families[p.family], p)
+	}
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		samples := families[name]
+		sort.Sort(promSamples(samples))
+		typeName := name
+		if samples[0].typ == "counter" && !openMetrics {
+			typeName += "_total"
+		}
+		bw.WriteString("# TYPE " + typeName + " " + samples[0].typ + "\n")
+		for _, p := range samples {
+			bw.WriteString(p.family + p.suffix)
+			labels := p.labels
+			if p.extraName != "" {
+				if labels != "" {
+					labels += ","
+				}
+				labels += p.extraName + `="` + p.extraValue + `"`
+			}
+			if labels != "" {
+				bw.WriteString("{" + labels + "}")
+			}
+			bw.WriteString(" " + promValue(p.value) + "\n")
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	return bw.Flush()
+}
+
+// Orders the samples of a family the way OpenMetrics requires: grouped by labels, then
+// buckets or quantiles in increasing order, then the count and the sum
+type promSamples []promPoint
+
+func (ps promSamples) Len() int      { return len(ps) }
+func (ps promSamples) Swap(i, j int) { ps[i], ps[j] = ps[j], ps[i] }
+func (ps promSamples) Less(i, j int) bool {
+	if ps[i].labels != ps[j].labels {
+		return ps[i].labels < ps[j].labels
+	}
+	if ri, rj := promSuffixRank[ps[i].suffix], promSuffixRank[ps[j].suffix]; ri != rj {
+		return ri < rj
+	}
+	vi, _ := strconv.ParseFloat(ps[i].extraValue, 64)
+	vj, _ := strconv.ParseFloat(ps[j].extraValue, 64)
+	return vi < vj
+}
+
+var promSuffixRank = map[string]int{"_count": 1, "_sum": 2}
+
+// Converts the metrics of a payload to Prometheus samples: those with the value of this flush,
+// and those to add to the totals
+func promPoints(metrics []*event.Metric) (instant, totals []promPoint) {
+	histograms := make(map[string]bool) // the timers with buckets
+	for _, m := range metrics {
+		if m.Type == "histogram" {
+			histograms[strings.TrimSuffix(m.Name, ".bucket")] = true
+		}
+	}
+	for _, m := range metrics {
+		switch m.Type {
+		case "counter":
+			family := strings.TrimSuffix(promName(m.Name), "_total")
+			totals = append(totals, promPoint{family: family, typ: "counter", suffix: "_total", labels: promLabels(m.Tags, ""), value: m.Value})
+			continue
+		case "cumulative_counter":
+			continue // the counter's own total already is one
+		case "histogram":
+			base := strings.TrimSuffix(m.Name, ".bucket")
+			totals = append(totals, promPoint{family: promName(base), typ: "histogram", suffix: "_bucket", labels: promLabels(m.Tags, "le"),
+				extraName: "le", extraValue: tagValue(m.Tags, "le"), value: m.Value})
+			continue
+		case "timer":
+			i := strings.LastIndex(m.Name, ".")
+			if i < 0 {
+				break
+			}
+			base, stat := m.Name[:i], m.Name[i+1:]
+			p := promPoint{family: promName(base), typ: "summary", labels: promLabels(m.Tags, ""), value: m.Value}
+			if histograms[base] {
+				p.typ = "histogram"
+			}
+			if stat == "count" || stat == "sum" {
+				p.suffix = "_" + stat
+				totals = append(totals, p)
+				continue
+			}
+			if q, ok := promQuantile(stat); ok && p.typ == "summary" {
+				p.extraName, p.extraValue = "quantile", q
+				instant = append(instant, p)
+				continue
+			}
+		}
+		// Gauges, and anything without a Prometheus equivalent, eg: a timer's min and max
+		instant = append(instant, promPoint{family: promName(m.Name), typ: "gauge", labels: promLabels(m.Tags, ""), value: m.Value})
+	}
+	return instant, totals
+}
+
+// Returns the quantile of a timer's upper_<pct> stat, eg: "0.95" for upper_95, "0.999" for upper_99_9
+func promQuantile(stat string) (string, bool) {
+	if !strings.HasPrefix(stat, "upper_") {
+		return "", false
+	}
+	pct, err := strconv.ParseFloat(strings.Replace(strings.TrimPrefix(stat, "upper_"), "_", ".", 1), 64)
+	if err != nil || pct <= 0 || pct > 100 {
+		return "", false
+	}
+	return strconv.FormatFloat(math.Round(pct*1e7)/1e9, 'g', -1, 64), true
+}
+
+// Replaces the characters Prometheus does not allow in metric names with underscores,
+// eg: "api.requests-total" becomes "api_requests_total"
+func promName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// Renders tags as sorted Prometheus labels. "key:value" tags become key="value" and tags without
+// a value become key="true". The skip tag, if any, is left out.
+func promLabels(tags []string, skip string) string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		key, value := tag, "true"
+		if i := strings.Index(tag, ":"); i >= 0 {
+			key, value = tag[:i], tag[i+1:]
+		}
+		if key == "" || key == skip {
+			continue
+		}
+		labels[promLabelName(key)] = value
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + `="` + promLabelValueReplacer.Replace(labels[k]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var promLabelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Sanitizes a tag key into a label name. Names Prometheus reserves, eg: le, get a tag_ prefix.
+func promLabelName(key string) string {
+	name := strings.Replace(promName(key), ":", "_", -1)
+	if name == "le" || name == "quantile" || strings.HasPrefix(name, "__") {
+		name = "tag_" + name
+	}
+	return name
+}
+
+// Returns the value of the key:value tag with the given key
+func tagValue(tags []string, key string) string {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, key+":") {
+			return tag[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func promValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,162 @@
+package sinks
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+func statsdPayload(metrics ...*event.Metric) []*collectors.CollectorPayload {
+	return []*collectors.CollectorPayload{{Name: "statsd", Type: "statsd", Metrics: metrics}}
+}
+
+func exposition(t *testing.T, s *PrometheusSink, openMetrics bool) string {
+	var buf bytes.Buffer
+	if err := s.WriteExposition(&buf, openMetrics); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestPrometheusCountersAndGauges(t *testing.T) {
+	s := NewPrometheusSink()
+	s.Write(statsdPayload(
+		&event.Metric{Name: "api.requests", Value: 3, Type: "counter", Tags: []string{"env:prod", "canary"}},
+		&event.Metric{Name: "api.requests.total", Value: 3, Type: "cumulative_counter", Tags: []string{"env:prod", "canary"}},
+		&event.Metric{Name: "queue-depth", Value: 7, Type: "gauge"},
+	))
+	s.Write(statsdPayload(
+		&event.Metric{Name: "api.requests", Value: 2, Type: "counter", Tags: []string{"env:prod", "canary"}},
+		&event.Metric{Name: "queue-depth", Value: 4, Type: "gauge"},
+	))
+	expected := `# TYPE api_requests_total counter
+api_requests_total{canary="true",env="prod"} 5
+# TYPE queue_depth gauge
+queue_depth 4
+`
+	if out := exposition(t, s, false); out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestPrometheusSummary(t *testing.T) {
+	s := NewPrometheusSink()
+	timer := &event.Timing{Name: "db.query", Tags: []string{"db:main"}, Percentiles: []float64{0.5, 0.999}}
+	for _, v := range []float64{10, 20, 30, 40} {
+		timer.Update(event.NewTiming("db.query", v))
+	}
+	s.Write(statsdPayload(timer.Metrics()...))
+	s.Write(statsdPayload(timer.Metrics()...))
+	out := exposition(t, s, false)
+	for _, line := range []string{
+		"# TYPE db_query summary\n",
+		`db_query{db="main",quantile="0.5"} 20` + "\n",
+		`db_query{db="main",quantile="0.999"} 40` + "\n",
+		`db_query_count{db="main"} 8` + "\n",
+		`db_query_sum{db="main"} 200` + "\n",
+		"# TYPE db_query_max gauge\n",
+		`db_query_max{db="main"} 40` + "\n",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("expected %q in:\n%s", line, out)
+		}
+	}
+	if strings.Index(out, "quantile=\"0.999\"") > strings.Index(out, "db_query_count") {
+		t.Errorf("expected the quantiles before the count:\n%s", out)
+	}
+}
+
+func TestPrometheusHistogram(t *testing.T) {
+	s := NewPrometheusSink()
+	timer := &event.Timing{Name: "http.latency", Buckets: []float64{0.5, 10}}
+	for _, v := range []float64{0.1, 5, 50} {
+		timer.Update(event.NewTiming("http.latency", v))
+	}
+	s.Write(statsdPayload(timer.Metrics()...))
+	out := exposition(t, s, true)
+	expected := `# TYPE http_latency histogram
+http_latency_bucket{le="0.5"} 1
+http_latency_bucket{le="10"} 2
+http_latency_bucket{le="+Inf"} 3
+http_latency_count 3
+http_latency_sum 55.1
+`
+	if !strings.Contains(out, expected) {
+		t.Errorf("expected:\n%s\nin:\n%s", expected, out)
+	}
+	if !strings.Contains(out, "# TYPE http_latency_upper_95 gauge\n") {
+		t.Errorf("expected the percentile of a histogram timer as a gauge:\n%s", out)
+	}
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Errorf("expected OpenMetrics output to end with # EOF:\n%s", out)
+	}
+}
+
+func TestPrometheusOpenMetricsCounter(t *testing.T) {
+	s := NewPrometheusSink()
+	s.Write(statsdPayload(&event.Metric{Name: "jobs_total", Value: 1, Type: "counter"}))
+	expected := "# TYPE jobs counter\njobs_total 1\n# EOF\n"
+	if out := exposition(t, s, true); out != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+}
+
+func TestPrometheusSeriesTTL(t *testing.T) {
+	s := NewPrometheusSink()
+	s.SetSeriesTTL(time.Hour)
+	now := time.Now()
+	s.writeAt(statsdPayload(&event.Metric{Name: "old", Value: 1, Type: "counter"}, &event.Metric{Name: "jobs", Value: 1, Type: "counter"}), now)
+	s.writeAt(statsdPayload(&event.Metric{Name: "jobs", Value: 2, Type: "counter"}), now.Add(30*time.Minute))
+	out := exposition(t, s, false)
+	if !strings.Contains(out, "old_total 1\n") || !strings.Contains(out, "jobs_total 3\n") {
+		t.Errorf("expected both counters before the TTL:\n%s", out)
+	}
+	s.writeAt(statsdPayload(&event.Metric{Name: "jobs", Value: 1, Type: "counter"}), now.Add(90*time.Minute))
+	out = exposition(t, s, false)
+	if strings.Contains(out, "old") || !strings.Contains(out, "jobs_total 4\n") {
+		t.Errorf("expected only the counter flushed within the TTL:\n%s", out)
+	}
+}
+
+func TestPromNames(t *testing.T) {
+	names := map[string]string{
+		"api.requests":   "api_requests",
+		"5xx.errors":     "_5xx_errors",
+		"a:b/c d":        "a:b_c_d",
+		"already_fine_1": "already_fine_1",
+	}
+	for name, expected := range names {
+		if promName(name) != expected {
+			t.Errorf("expected %q for %q, got %q", expected, name, promName(name))
+		}
+	}
+	labels := promLabels([]string{"le:1", "__name__:x", "region:eu-west", "msg:say \"hi\"\n", "host.name:a"}, "")
+	expected := `host_name="a",msg="say \"hi\"\n",region="eu-west",tag___name__="x",tag_le="1"`
+	if labels != expected {
+		t.Errorf("expected labels %s, got %s", expected, labels)
+	}
+}
+
+func TestPrometheusServeHTTP(t *testing.T) {
+	s := NewPrometheusSink()
+	s.Write(statsdPayload(&event.Metric{Name: "up", Value: 1, Type: "gauge"}))
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Header().Get("Content-Type") != PrometheusTextType || w.Body.String() != "# TYPE up gauge\nup 1\n" {
+		t.Errorf("unexpected text exposition %q: %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;q=0.5")
+	s.ServeHTTP(w, r)
+	if w.Header().Get("Content-Type") != OpenMetricsType || !strings.HasSuffix(w.Body.String(), "# EOF\n") {
+		t.Errorf("unexpected OpenMetrics exposition %q: %q", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
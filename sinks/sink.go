@@ -0,0 +1,331 @@
+// Package sinks delivers the payloads flushed by scoutd's collectors to their destinations.
+// Each sink gets every flushed payload set through its own queue, so a slow or failing sink
+// never holds up the collectors or the other sinks.
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+const (
+	DefaultQueueSize     = 10
+	DefaultMaxRetries    = 3
+	DefaultRetryInterval = time.Second
+	maxRetryInterval     = time.Minute
+)
+
+// A destination for flushed collector payloads
+type Sink interface {
+	Name() string
+	// Delivers one flushed payload set. An error means the write may be retried, unless it
+	// is Permanent.
+	Write(payloads []*collectors.CollectorPayload) error
+	// Releases the sink's resources once no more writes will be made
+	Close() error
+}
+
+// Creates a sink from the options of one item of the sinks section of scoutd.yml
+type Factory func(options map[string]string) (Sink, error)
+
+var factories = map[string]Factory{}
+
+// Makes a sink type available to New(). Called from the init() of each sink type.
+func Register(sinkType string, factory Factory) {
+	factories[sinkType] = factory
+}
+
+// Creates a sink of the type given by options["type"]
+func New(options map[string]string) (Sink, error) {
+	factory, ok := factories[options["type"]]
+	if !ok {
+		types := []string{}
+		for t := range factories {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return nil, fmt.Errorf("unknown sink type %q, expected one of %v", options["type"], types)
+	}
+	return factory(options)
+}
+
+// An error that retrying the write would not fix, eg: data the destination rejected
+type permanentError struct {
+	error
+}
+
+// Marks err as one the Manager should not retry the write for
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Posts body to url with the given headers, gzipped if compress is true. Responses the server
+// would give again, ie: 4xx apart from 429 Too Many Requests, are Permanent errors.
+func post(client *http.Client, url string, body []byte, headers map[string]string, compress bool) error {
+	if compress {
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		gz.Write(body)
+		gz.Close()
+		body = compressed.Bytes()
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s responded %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(msg)))
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// How a queued sink retries failed writes
+type RetryPolicy struct {
+	MaxRetries int           // Retries after the first failed attempt, before the payload set is dropped
+	Interval   time.Duration // Wait before the first retry, doubled for each one after it
+}
+
+// Reads the queue_size, max_retries and retry_interval options, with defaults for the ones
+// that are not set
+func QueueOptions(options map[string]string) (int, RetryPolicy, error) {
+	queueSize := DefaultQueueSize
+	retry := RetryPolicy{MaxRetries: DefaultMaxRetries, Interval: DefaultRetryInterval}
+	var err error
+	if v := options["queue_size"]; v != "" {
+		if queueSize, err = strconv.Atoi(v); err != nil || queueSize < 1 {
+			return 0, retry, fmt.Errorf("invalid queue_size %q", v)
+		}
+	}
+	if v := options["max_retries"]; v != "" {
+		if retry.MaxRetries, err = strconv.Atoi(v); err != nil || retry.MaxRetries < 0 {
+			return 0, retry, fmt.Errorf("invalid max_retries %q", v)
+		}
+	}
+	if v := options["retry_interval"]; v != "" {
+		if retry.Interval, err = time.ParseDuration(v); err != nil || retry.Interval <= 0 {
+			return 0, retry, fmt.Errorf("invalid retry_interval %q", v)
+		}
+	}
+	return queueSize, retry, nil
+}
+
+// Delivery counts for a sink
+type Stats struct {
+	Written int64 // payload sets written
+	Retries int64 // failed attempts that were retried
+	Failed  int64 // payload sets dropped after all retries failed
+	Dropped int64 // payload sets dropped because the queue was full
+}
+
+type queuedSink struct {
+	sink   Sink
+	queue  chan []*collectors.CollectorPayload
+	retry  RetryPolicy
+	closed chan bool
+	done   chan bool
+	stats  Stats
+}
+
+// Writes the queued payload sets until the queue is closed
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for payloads := range q.queue {
+		q.deliver(payloads)
+	}
+}
+
+func (q *queuedSink) deliver(payloads []*collectors.CollectorPayload) {
+	wait := q.retry.Interval
+	for attempt := 0; ; attempt++ {
+		err := q.write(payloads)
+		if err == nil {
+			atomic.AddInt64(&q.stats.Written, 1)
+			return
+		}
+		if _, permanent := err.(permanentError); permanent || attempt >= q.retry.MaxRetries {
+			atomic.AddInt64(&q.stats.Failed, 1)
+			log.Printf("sink %s: dropping payload after %d attempts: %s", q.sink.Name(), attempt+1, err)
+			return
+		}
+		atomic.AddInt64(&q.stats.Retries, 1)
+		select {
+		case <-time.After(wait):
+		case <-q.closed:
+			atomic.AddInt64(&q.stats.Failed, 1)
+			return
+		}
+		if wait *= 2; wait > maxRetryInterval {
+			wait = maxRetryInterval
+		}
+	}
+}
+
+// Calls the sink's Write, turning a panic into an error so one broken sink cannot take
+// scoutd down
+func (q *queuedSink) write(payloads []*collectors.CollectorPayload) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return q.sink.Write(payloads)
+}
+
+// Queues payloads, dropping the oldest queued payload set if the queue is full, as the
+// newest data is the most useful
+func (q *queuedSink) enqueue(payloads []*collectors.CollectorPayload) {
+	for {
+		select {
+		case q.queue <- payloads:
+			return
+		default:
+		}
+		select {
+		case <-q.queue:
+			atomic.AddInt64(&q.stats.Dropped, 1)
+		default:
+		}
+	}
+}
+
+// Fans each flushed payload set out to the sinks
+type Manager struct {
+	mutex  sync.RWMutex
+	sinks  []*queuedSink
+	closed bool
+}
+
+func NewManager() *Manager {
+	return &Manager{}
+}
+
+// Starts delivering to s, with a queue of queueSize payload sets
+func (m *Manager) Add(s Sink, queueSize int, retry RetryPolicy) {
+	q := &queuedSink{
+		sink:   s,
+		queue:  make(chan []*collectors.CollectorPayload, queueSize),
+		retry:  retry,
+		closed: make(chan bool),
+		done:   make(chan bool),
+	}
+	go q.run()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sinks = append(m.sinks, q)
+}
+
+// Queues payloads for every sink. Never blocks.
+func (m *Manager) Publish(payloads []*collectors.CollectorPayload) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.closed {
+		return
+	}
+	for _, q := range m.sinks {
+		q.enqueue(payloads)
+	}
+}
+
+// Returns the delivery counts of each sink, by name
+func (m *Manager) Stats() map[string]Stats {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	stats := make(map[string]Stats, len(m.sinks))
+	for _, q := range m.sinks {
+		stats[q.sink.Name()] = Stats{
+			Written: atomic.LoadInt64(&q.stats.Written),
+			Retries: atomic.LoadInt64(&q.stats.Retries),
+			Failed:  atomic.LoadInt64(&q.stats.Failed),
+			Dropped: atomic.LoadInt64(&q.stats.Dropped),
+		}
+	}
+	return stats
+}
+
+// Delivers the queued payload sets, waiting at most timeout, and closes the sinks.
+// Failed writes are not retried any more. A sink still writing when the timeout expires is
+// left open, as Close must not be called during a Write.
+func (m *Manager) Close(timeout time.Duration) {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+	for _, q := range m.sinks {
+		close(q.closed)
+		close(q.queue)
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	for _, q := range m.sinks {
+		if !expired {
+			select {
+			case <-q.done:
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-q.done:
+		default:
+			log.Printf("sink %s: still writing after %s, not closing it", q.sink.Name(), timeout)
+			continue
+		}
+		if err := q.sink.Close(); err != nil {
+			log.Printf("sink %s: error closing: %s", q.sink.Name(), err)
+		}
+	}
+}
+
+// Returns payloads without the metrics whose values are NaN or infinite, which json can't encode
+// and most destinations can't store.
+// The payloads are shared with the other sinks, so the ones with such metrics are copied.
+func finitePayloads(payloads []*collectors.CollectorPayload) []*collectors.CollectorPayload {
+	result := make([]*collectors.CollectorPayload, len(payloads))
+	for i, p := range payloads {
+		result[i] = p
+		finite := make([]*event.Metric, 0, len(p.Metrics))
+		for _, m := range p.Metrics {
+			if !math.IsNaN(m.Value) && !math.IsInf(m.Value, 0) {
+				finite = append(finite, m)
+			}
+		}
+		if len(finite) < len(p.Metrics) {
+			copied := *p
+			copied.Metrics = finite
+			result[i] = &copied
+		}
+	}
+	return result
+}
@@ -0,0 +1,269 @@
+package sinks
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingdomserver/scoutd/collectors"
+	"github.com/pingdomserver/scoutd/collectors/event"
+)
+
+// A stand-in for the HTTP endpoints sinks post to, recording the requests and their bodies
+type recordingServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []*http.Request
+	bodies   []string
+	status   int
+}
+
+func newRecordingServer() *recordingServer {
+	s := &recordingServer{status: http.StatusNoContent}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			body, _ = ioutil.ReadAll(gz)
+		} else {
+			body, _ = ioutil.ReadAll(r.Body)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.requests = append(s.requests, r)
+		s.bodies = append(s.bodies, string(body))
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+type testSink struct {
+	name     string
+	entered  chan bool
+	mutex    sync.Mutex
+	written  [][]*collectors.CollectorPayload
+	failures int
+	block    chan bool
+	panics   bool
+	closed   bool
+}
+
+func (s *testSink) Name() string {
+	return s.name
+}
+
+func (s *testSink) Write(payloads []*collectors.CollectorPayload) error {
+	if s.entered != nil {
+		s.entered <- true
+	}
+	if s.block != nil {
+		<-s.block
+	}
+	if s.panics {
+		panic("broken sink")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("write failed")
+	}
+	s.written = append(s.written, payloads)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.written)
+}
+
+func testPayloads(name string) []*collectors.CollectorPayload {
+	return []*collectors.CollectorPayload{{Name: name}}
+}
+
+func TestManagerRetries(t *testing.T) {
+	s := &testSink{name: "test", failures: 2}
+	m := NewManager()
+	m.Add(s, 10, RetryPolicy{MaxRetries: 2, Interval: time.Millisecond})
+	m.Publish(testPayloads("a"))
+	for i := 0; i < 100 && s.count() == 0; i++ {
+		time.Sleep(10 * time.Millisecond) // Close() ends the retries
+	}
+	m.Close(time.Second)
+	if s.count() != 1 || !s.closed {
+		t.Fatalf("expected 1 write and a closed sink, got %d writes, closed %v", s.count(), s.closed)
+	}
+	if stats := m.Stats()["test"]; stats.Written != 1 || stats.Retries != 2 || stats.Failed != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestManagerGivesUp(t *testing.T) {
+	s := &testSink{name: "test", failures: 5}
+	m := NewManager()
+	m.Add(s, 10, RetryPolicy{MaxRetries: 1, Interval: time.Millisecond})
+	m.Publish(testPayloads("a"))
+	m.Close(time.Second)
+	if stats := m.Stats()["test"]; stats.Written != 0 || stats.Retries != 1 || stats.Failed != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestManagerSlowSink(t *testing.T) {
+	slow := &testSink{name: "slow", entered: make(chan bool, 10), block: make(chan bool)}
+	fast := &testSink{name: "fast"}
+	m := NewManager()
+	m.Add(slow, 2, RetryPolicy{})
+	m.Add(fast, 10, RetryPolicy{})
+
+	m.Publish(testPayloads("a"))
+	<-slow.entered // the slow sink is stuck writing "a"
+	done := make(chan bool)
+	go func() {
+		for _, name := range []string{"b", "c", "d", "e"} {
+			m.Publish(testPayloads(name))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow sink")
+	}
+	close(slow.block)
+	m.Close(time.Second)
+
+	if fast.count() != 5 {
+		t.Errorf("expected 5 writes to the fast sink, got %d", fast.count())
+	}
+	// The slow sink only had room for the newest two payload sets after "a"
+	if slow.count() != 3 || slow.written[1][0].Name != "d" || slow.written[2][0].Name != "e" {
+		t.Errorf("unexpected writes to the slow sink: %d", slow.count())
+	}
+	if stats := m.Stats()["slow"]; stats.Dropped != 2 || stats.Written != 3 {
+		t.Errorf("unexpected slow sink stats: %+v", stats)
+	}
+}
+
+func TestManagerCloseWhileWriting(t *testing.T) {
+	stuck := &testSink{name: "stuck", entered: make(chan bool, 1), block: make(chan bool)}
+	fast := &testSink{name: "fast"}
+	m := NewManager()
+	m.Add(stuck, 10, RetryPolicy{})
+	m.Add(fast, 10, RetryPolicy{})
+	m.Publish(testPayloads("a"))
+	<-stuck.entered
+	m.Close(50 * time.Millisecond)
+	if stuck.closed {
+		t.Errorf("Sink closed while it was still writing")
+	}
+	if !fast.closed {
+		t.Errorf("Sink that was done writing not closed")
+	}
+	close(stuck.block)
+}
+
+func TestManagerPanickingSink(t *testing.T) {
+	broken := &testSink{name: "test", panics: true}
+	m := NewManager()
+	m.Add(broken, 10, RetryPolicy{})
+	m.Publish(testPayloads("a"))
+	m.Close(time.Second)
+	if stats := m.Stats()["test"]; stats.Failed != 1 {
+		t.Errorf("expected the panic to count as a failure, got %+v", stats)
+	}
+}
+
+func TestQueueOptions(t *testing.T) {
+	queueSize, retry, err := QueueOptions(map[string]string{"queue_size": "5", "retry_interval": "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queueSize != 5 || retry.MaxRetries != DefaultMaxRetries || retry.Interval != 10*time.Second {
+		t.Errorf("unexpected options: %d %+v", queueSize, retry)
+	}
+	for _, options := range []map[string]string{{"queue_size": "0"}, {"max_retries": "x"}, {"retry_interval": "-1s"}} {
+		if _, _, err := QueueOptions(options); err == nil {
+			t.Errorf("expected an error for %v", options)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	Register("registered", func(options map[string]string) (Sink, error) {
+		return &testSink{name: options["name"]}, nil
+	})
+	defer delete(factories, "registered")
+	if s, err := New(map[string]string{"type": "registered", "name": "mine"}); err != nil || s.Name() != "mine" {
+		t.Errorf("expected a registered sink, got %v, %v", s, err)
+	}
+	// The payload endpoint is always served, it is not a configurable sink
+	for _, sinkType := range []string{"nope", "http"} {
+		if _, err := New(map[string]string{"type": sinkType}); err == nil {
+			t.Errorf("expected an error for the unknown sink type %s", sinkType)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	s := NewHTTPSink()
+	var bundle collectors.PayloadBundle
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if bundle.SchemaVersion != collectors.PayloadSchemaVersion || len(bundle.Collectors) != 0 {
+		t.Errorf("unexpected bundle before the first write: %s", w.Body.String())
+	}
+
+	s.Write(testPayloads("statsd"))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Collectors) != 1 || bundle.Collectors[0].Name != "statsd" {
+		t.Errorf("unexpected bundle: %s", w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected content type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHTTPSinkNonFinite(t *testing.T) {
+	s := NewHTTPSink()
+	payloads := statsdPayload(&event.Metric{Name: "a", Value: 1, Type: "gauge"}, &event.Metric{Name: "b", Value: math.NaN(), Type: "gauge"})
+	if err := s.Write(payloads); err != nil {
+		t.Fatalf("write with a NaN value: %s", err)
+	}
+	var bundle collectors.PayloadBundle
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Collectors) != 1 || len(bundle.Collectors[0].Metrics) != 1 || bundle.Collectors[0].Metrics[0].Name != "a" {
+		t.Errorf("unexpected bundle: %s", w.Body.String())
+	}
+	if len(payloads[0].Metrics) != 2 {
+		t.Errorf("the payload shared with the other sinks was changed")
+	}
+}